@@ -0,0 +1,175 @@
+package ddblock
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// ErrTooManyLocks is returned by AcquireAll for more locks
+// than can be written in one transaction.
+var ErrTooManyLocks = errors.New("ddbmutex: too many locks for one transaction")
+
+// AcquireAll takes the named locks of the client in a single transaction,
+// all of them or none, so a workflow that needs several resources never
+// holds only some of them while waiting for the others. At most 100 locks
+// can be taken at once. The mutexes are created with the context, as with
+// New, and are then renewed and unlocked individually. If any of the locks
+// is held by someone else a *ConflictError, matching ErrConflict, is
+// returned with the holder of the first one. ErrNotTransactional is
+// returned if the client uses a Backend or a Mode other than Enforce.
+func (c *Client) AcquireAll(ctx context.Context, names ...string) ([]*Mutex, error) {
+	if len(names) > maxTransactItems {
+		return nil, ErrTooManyLocks
+	}
+
+	ms := make([]*Mutex, len(names))
+	for i, name := range names {
+		ms[i] = c.New(ctx, name)
+	}
+
+	if err := acquireAll(ctx, ms); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+// AcquireAll takes the named locks, in the DefaultTableName with the
+// DefaultPrefix, in a single transaction. See Client.AcquireAll.
+func AcquireAll(ctx context.Context, names ...string) ([]*Mutex, error) {
+	return defaultClient().AcquireAll(ctx, names...)
+}
+
+// acquireAll creates the lock items of the new mutexes in one transaction
+// and starts their leases.
+func acquireAll(ctx context.Context, ms []*Mutex) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	for i, m := range ms {
+		if _, err := m.takeSlot(); err != nil {
+			for _, m := range ms[:i] {
+				m.lk.Lock()
+				m.releaseSlot()
+				m.lk.Unlock()
+			}
+
+			return err
+		}
+	}
+
+	err := transactCreate(ctx, ms)
+	if err != nil {
+		for _, m := range ms {
+			m.lk.Lock()
+			m.releaseSlot()
+			m.lk.Unlock()
+		}
+
+		return err
+	}
+
+	for _, m := range ms {
+		m.startLease()
+	}
+
+	return nil
+}
+
+// transactCreate writes the lock items of the mutexes, which must not be
+// shared yet, in one transaction. ErrNotTransactional is returned if any of
+// them is stored in a Backend or is not enforced.
+func transactCreate(ctx context.Context, ms []*Mutex) error {
+	fences := make([]string, len(ms))
+	for i, m := range ms {
+		owner := m.identity()
+
+		m.lk.Lock()
+		defer m.lk.Unlock()
+
+		if m.backend != nil || m.resolveMode() != Enforce {
+			return ErrNotTransactional
+		}
+
+		m.mode = Enforce
+		m.uuid = newUUID()
+		if err := m.checkPolicy(); err != nil {
+			return err
+		}
+
+		m.owner = owner
+		if m.Fencing {
+			var err error
+			if fences[i], err = m.nextFence(); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	ttls := make([]time.Duration, len(ms))
+	puts := make([]*dynamodb.PutItemInput, len(ms))
+	items := make([]*dynamodb.TransactWriteItem, len(ms))
+	for i, m := range ms {
+		ttls[i] = m.cleanTTL()
+		puts[i] = m.createInput(now, ttls[i])
+		if m.Fencing {
+			m.fenceCondition(puts[i], fences[i])
+		}
+
+		items[i] = &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:                           puts[i].TableName,
+				Item:                                puts[i].Item,
+				ConditionExpression:                 puts[i].ConditionExpression,
+				ExpressionAttributeNames:            puts[i].ExpressionAttributeNames,
+				ExpressionAttributeValues:           puts[i].ExpressionAttributeValues,
+				ReturnValuesOnConditionCheckFailure: puts[i].ReturnValuesOnConditionCheckFailure,
+			},
+		}
+	}
+
+	start := time.Now()
+	_, err := ms[0].db().TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	for _, m := range ms {
+		m.trace(OpAcquire, start, err)
+		if err != nil {
+			m.fence = 0
+		}
+	}
+
+	if e, ok := err.(*dynamodb.TransactionCanceledException); ok && len(e.CancellationReasons) == len(ms) {
+		for i, r := range e.CancellationReasons {
+			if aws.StringValue(r.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+
+			var holder *LockInfo
+			if len(r.Item) > 0 {
+				holder = ms[i].Schema.lockInfo(r.Item)
+			}
+
+			ms[i].recordConflict(now, holder)
+			return &ConflictError{Holder: holder, Err: err}
+		}
+	}
+
+	if err != nil {
+		return wrapError(err)
+	}
+
+	for i, m := range ms {
+		// the previous items are not returned by transactions
+		m.created(now, ttls[i], puts[i].Item, nil)
+	}
+
+	return nil
+}
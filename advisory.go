@@ -0,0 +1,203 @@
+package ddblock
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Mode controls how a Mutex enforces mutual exclusion.
+type Mode int
+
+const (
+	// Enforce is the default mode, TryLock fails if someone else holds the lock.
+	Enforce Mode = iota
+
+	// Advisory records the intent and ownership of the lock but never
+	// blocks others. TryLock always succeeds and Others returns who else
+	// currently holds the advisory lock. This is useful for gradual adoption
+	// and for surfacing warnings about concurrent edits. Advisory locks are
+	// stored in their own item so they do not interfere with enforced ones.
+	Advisory
+
+	// Shadow observes contention without enforcing mutual exclusion.
+	// The lock item is written as usual but TryLock always succeeds locally,
+	// what the outcome would have been is counted in the "ddblock_shadow"
+	// expvar map. This lets teams measure contention before turning on
+	// real locking.
+	Shadow
+
+	// Rollout enforces a percentage of locks, set by EnforcePercent, and runs
+	// the rest in Shadow mode. This lets the change to real locking be
+	// canaried across a large fleet instead of flipped all at once.
+	Rollout
+)
+
+// resolveMode returns the mode to use for a lock attempt,
+// choosing between Enforce and Shadow for the Rollout mode.
+func (m *Mutex) resolveMode() Mode {
+	if m.Mode != Rollout {
+		return m.Mode
+	}
+
+	var v float64
+	if m.RolloutByAcquisition {
+		v = rand.Float64() * 100
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(m.name))
+		v = float64(h.Sum32()%10000) / 100
+	}
+
+	if v < m.EnforcePercent {
+		return Enforce
+	}
+
+	return Shadow
+}
+
+// advisoryHolderPrefix prefixes the attribute for each holder
+// on the advisory item, followed by the holder's uuid.
+const advisoryHolderPrefix = "h_"
+
+// Others returns the other holders of an Advisory lock as of the last
+// successful acquisition or renewal. Expired holders are not included.
+func (m *Mutex) Others() []*LockInfo {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.others
+}
+
+// advisoryKey returns the key of the item holding the advisory lock.
+func (m *Mutex) advisoryKey() map[string]*dynamodb.AttributeValue {
+	return m.Schema.key(m.fullname + "#advisory")
+}
+
+// putAdvisory adds or refreshes our holder attribute on the advisory item
+// and records the other current holders. Must be called with m.lk held.
+func (m *Mutex) putAdvisory(op Op) error {
+	now := time.Now()
+	ttl := m.cleanTTL()
+	if op == OpRenew {
+		ttl = m.renewalTTL()
+	}
+
+	holder := map[string]*dynamodb.AttributeValue{
+		"expires": {
+			N: aws.String(m.formatExpires(now.Add(ttl))),
+		},
+	}
+	if m.owner != nil {
+		holder[ownerString] = m.owner.attribute()
+	}
+
+	params := &dynamodb.UpdateItemInput{
+		TableName:        &m.TableName,
+		Key:              m.advisoryKey(),
+		UpdateExpression: aws.String("SET #me = :holder, #ttl = :ttl"),
+		ExpressionAttributeNames: map[string]*string{
+			"#me":  aws.String(advisoryHolderPrefix + m.uuid),
+			"#ttl": &ttlString,
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {
+				M: holder,
+			},
+			":ttl": ttlAttribute(now.Add(ttl)),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+
+	start := time.Now()
+	resp, err := m.db().UpdateItemWithContext(m.opContext(), params)
+	m.trace(op, start, err)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+
+	m.others = nil
+	var expired []string
+	for k, v := range resp.Attributes {
+		if !strings.HasPrefix(k, advisoryHolderPrefix) || k == advisoryHolderPrefix+m.uuid {
+			continue
+		}
+
+		info := &LockInfo{
+			Name: m.fullname,
+			UUID: strings.TrimPrefix(k, advisoryHolderPrefix),
+		}
+		if e := v.M["expires"]; e != nil {
+			info.Expires, _ = parseExpires(aws.StringValue(e.N))
+		}
+		if o := v.M[ownerString]; o != nil {
+			info.Owner = ownerFromAttribute(o)
+		}
+
+		if info.Expires.After(now.Add(-m.Grace)) {
+			m.others = append(m.others, info)
+		} else {
+			expired = append(expired, k)
+		}
+	}
+
+	if len(expired) > 0 {
+		m.removeExpiredAdvisory(op, expired)
+	}
+
+	return nil
+}
+
+// removeExpiredAdvisory removes the attributes of holders that did not
+// release the advisory lock. It is best effort, a removed holder that is
+// in fact still alive adds itself back on its next renewal. The removal
+// is traced as part of op, its error is otherwise ignored.
+func (m *Mutex) removeExpiredAdvisory(op Op, attrs []string) {
+	names := make(map[string]*string, len(attrs))
+	refs := make([]string, 0, len(attrs))
+	for i, a := range attrs {
+		ref := "#h" + strconv.Itoa(i)
+		names[ref] = aws.String(a)
+		refs = append(refs, ref)
+	}
+
+	start := time.Now()
+	_, err := m.db().UpdateItemWithContext(m.opContext(), &dynamodb.UpdateItemInput{
+		TableName:                &m.TableName,
+		Key:                      m.advisoryKey(),
+		UpdateExpression:         aws.String("REMOVE " + strings.Join(refs, ", ")),
+		ExpressionAttributeNames: names,
+	})
+	m.trace(op, start, err)
+}
+
+// removeAdvisory removes our holder attribute from the advisory item.
+// Must be called with m.lk held.
+func (m *Mutex) removeAdvisory() error {
+	params := &dynamodb.UpdateItemInput{
+		TableName:        &m.TableName,
+		Key:              m.advisoryKey(),
+		UpdateExpression: aws.String("REMOVE #me"),
+		ExpressionAttributeNames: map[string]*string{
+			"#me": aws.String(advisoryHolderPrefix + m.uuid),
+		},
+	}
+
+	start := time.Now()
+	_, err := m.db().UpdateItemWithContext(m.opContext(), params)
+	m.trace(OpRelease, start, err)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	m.clearLease()
+	return nil
+}
@@ -0,0 +1,72 @@
+package ddblock
+
+import (
+	"time"
+)
+
+// AuditAction is a lifecycle transition of a lock held by a Mutex.
+type AuditAction string
+
+const (
+	// AuditAcquire is the lock being acquired while free.
+	AuditAcquire AuditAction = "acquire"
+
+	// AuditSteal is the lock being taken over from an expired holder.
+	AuditSteal AuditAction = "steal"
+
+	// AuditRelease is the lock being released by its holder.
+	AuditRelease AuditAction = "release"
+
+	// AuditAbandon is the holder giving up the lock without releasing it,
+	// leaving the item to lapse.
+	AuditAbandon AuditAction = "abandon"
+
+	// AuditLost is the lock being found taken by another holder.
+	AuditLost AuditAction = "lost"
+
+	// AuditForceRelease is the lock item being found removed,
+	// for example by a tool, while the lease was still intact.
+	AuditForceRelease AuditAction = "force-release"
+)
+
+// AuditEvent describes one lifecycle transition of a lock.
+type AuditEvent struct {
+	Time   time.Time   `json:"time"`
+	Action AuditAction `json:"action"`
+	Table  string      `json:"table"`
+	Name   string      `json:"name"`
+	UUID   string      `json:"uuid"`
+	Owner  *Owner      `json:"owner,omitempty"`
+
+	// Previous is the replaced holder for AuditSteal.
+	Previous *LockInfo `json:"previous,omitempty"`
+}
+
+// Auditor receives the lifecycle events of locks, for example to ship them
+// to a durable audit log. Audit is called with the mutex locked, so it must
+// not block nor call the mutex. See the audit package for implementations.
+type Auditor interface {
+	Audit(AuditEvent)
+}
+
+// audit sends the transition to the Auditors of the mutex.
+// Must be called with m.lk held, before the lease is cleared.
+func (m *Mutex) audit(action AuditAction, previous *LockInfo) {
+	if len(m.Auditors) == 0 {
+		return
+	}
+
+	e := AuditEvent{
+		Time:     time.Now(),
+		Action:   action,
+		Table:    m.TableName,
+		Name:     m.name,
+		UUID:     m.uuid,
+		Owner:    m.owner,
+		Previous: previous,
+	}
+
+	for _, a := range m.Auditors {
+		a.Audit(e)
+	}
+}
@@ -0,0 +1,192 @@
+// Package audit ships the lifecycle events of ddblock locks in batches to
+// a durable log, such as Kinesis Firehose or S3, without bloating the lock
+// table. Add a Shipper to the Auditors of each Mutex:
+//
+//	shipper := audit.NewShipper(audit.NewFirehose(firehose.New(sess), "lock-audit"))
+//	defer shipper.Close(ctx)
+//
+//	m := ddblock.New(ctx, "name")
+//	m.Auditors = append(m.Auditors, shipper)
+//
+// A LossAlert instead notifies an SNS topic or webhook right away
+// when a lock is lost or force released.
+package audit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// DefaultFlushInterval is how often buffered events are written.
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultMaxBatch is the most events written at once.
+	DefaultMaxBatch = 500
+
+	// DefaultQueueSize is the number of events buffered before new ones
+	// are dropped, for example while the log can not be written.
+	DefaultQueueSize = 10000
+)
+
+// Writer writes a batch of events to the log.
+type Writer interface {
+	Write(ctx context.Context, events []ddblock.AuditEvent) error
+}
+
+// Shipper is a ddblock.Auditor that buffers events and writes them in
+// batches, every FlushInterval or once MaxBatch events are buffered.
+// The fields must be set before the first event.
+type Shipper struct {
+	Writer        Writer
+	FlushInterval time.Duration
+	MaxBatch      int
+
+	// OnError, if set, is called with the events that could not be written.
+	// If not set errors are logged with the Logger.
+	OnError func(err error, events []ddblock.AuditEvent)
+
+	// Logger defaults to ddblock.DefaultLogger.
+	Logger ddblock.Logger
+
+	once    sync.Once
+	queue   chan ddblock.AuditEvent
+	closing chan context.Context
+	stopped chan struct{}
+	dropped int64
+}
+
+// NewShipper creates a shipper writing to w with the defaults.
+func NewShipper(w Writer) *Shipper {
+	return &Shipper{
+		Writer:        w,
+		FlushInterval: DefaultFlushInterval,
+		MaxBatch:      DefaultMaxBatch,
+	}
+}
+
+// Audit queues the event without blocking. It is dropped if the queue is full.
+func (s *Shipper) Audit(e ddblock.AuditEvent) {
+	s.start()
+
+	select {
+	case s.queue <- e:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *Shipper) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close writes the buffered events and stops the shipper.
+// Events audited after Close are not written.
+func (s *Shipper) Close(ctx context.Context) error {
+	s.start()
+
+	select {
+	case s.closing <- ctx:
+	case <-s.stopped:
+		return nil
+	}
+
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Shipper) start() {
+	s.once.Do(func() {
+		s.queue = make(chan ddblock.AuditEvent, DefaultQueueSize)
+		s.closing = make(chan context.Context)
+		s.stopped = make(chan struct{})
+
+		go s.run()
+	})
+}
+
+func (s *Shipper) run() {
+	defer close(s.stopped)
+
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	max := s.MaxBatch
+	if max <= 0 {
+		max = DefaultMaxBatch
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var batch []ddblock.AuditEvent
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < max {
+				continue
+			}
+		case <-t.C:
+		case ctx := <-s.closing:
+			s.drain(ctx, batch, max)
+			return
+		}
+
+		batch = s.write(context.Background(), batch)
+	}
+}
+
+// drain writes the batch and all the queued events.
+func (s *Shipper) drain(ctx context.Context, batch []ddblock.AuditEvent, max int) {
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) >= max {
+				batch = s.write(ctx, batch)
+			}
+		default:
+			s.write(ctx, batch)
+			return
+		}
+	}
+}
+
+// logger returns the logger, or the DefaultLogger if nil.
+func logger(l ddblock.Logger) ddblock.Logger {
+	if l != nil {
+		return l
+	}
+
+	return ddblock.DefaultLogger()
+}
+
+// write writes the batch and returns it emptied for reuse.
+func (s *Shipper) write(ctx context.Context, batch []ddblock.AuditEvent) []ddblock.AuditEvent {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err := s.Writer.Write(ctx, batch); err != nil {
+		if s.OnError != nil {
+			s.OnError(err, append([]ddblock.AuditEvent(nil), batch...))
+		} else {
+			logger(s.Logger).Error("ddblock/audit: writing events", "events", len(batch), "error", err)
+		}
+	}
+
+	return batch[:0]
+}
@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// eventBridgeMaxEntries is the most entries in one PutEvents call.
+const eventBridgeMaxEntries = 10
+
+// EventBridgeSource is the source of the events published by EventBridge.
+const EventBridgeSource = "ddblock"
+
+// EventBridge publishes events to an EventBridge bus so rules can start
+// Step Functions or Lambda remediation on lock transitions. The detail type
+// is "Lock " followed by the action, for example "Lock lost", and the detail
+// is the event as JSON. Use a Shipper with a short FlushInterval to limit
+// the delay.
+type EventBridge struct {
+	Client eventbridgeiface.EventBridgeAPI
+
+	// EventBus is the name or arn of the bus, empty for the default bus.
+	EventBus string
+
+	// Actions, if set, limits the published events to these actions.
+	Actions []ddblock.AuditAction
+}
+
+// NewEventBridge creates a writer publishing all events to the bus.
+func NewEventBridge(client eventbridgeiface.EventBridgeAPI, eventBus string) *EventBridge {
+	return &EventBridge{
+		Client:   client,
+		EventBus: eventBus,
+	}
+}
+
+// Write publishes the events with the selected actions.
+func (b *EventBridge) Write(ctx context.Context, events []ddblock.AuditEvent) error {
+	var entries []*eventbridge.PutEventsRequestEntry
+	for _, e := range events {
+		if !b.selected(e.Action) {
+			continue
+		}
+
+		detail, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		entry := &eventbridge.PutEventsRequestEntry{
+			Source:     aws.String(EventBridgeSource),
+			DetailType: aws.String("Lock " + string(e.Action)),
+			Detail:     aws.String(string(detail)),
+			Time:       aws.Time(e.Time),
+		}
+		if b.EventBus != "" {
+			entry.EventBusName = &b.EventBus
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > eventBridgeMaxEntries {
+			n = eventBridgeMaxEntries
+		}
+
+		resp, err := b.Client.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+			Entries: entries[:n],
+		})
+		if err != nil {
+			return err
+		}
+
+		if failed := aws.Int64Value(resp.FailedEntryCount); failed > 0 {
+			var message string
+			for _, r := range resp.Entries {
+				if r.ErrorCode != nil {
+					message = aws.StringValue(r.ErrorMessage)
+				}
+			}
+
+			return fmt.Errorf("ddblock/audit: %d events rejected by eventbridge: %s", failed, message)
+		}
+
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+func (b *EventBridge) selected(action ddblock.AuditAction) bool {
+	if len(b.Actions) == 0 {
+		return true
+	}
+
+	for _, a := range b.Actions {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
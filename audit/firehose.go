@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// firehoseMaxRecords is the most records in one PutRecordBatch call.
+const firehoseMaxRecords = 500
+
+// firehoseAttempts is how many times records rejected
+// by the delivery stream are sent.
+const firehoseAttempts = 3
+
+// Firehose writes events to a Kinesis Firehose delivery stream,
+// one newline terminated JSON object per record.
+type Firehose struct {
+	Client         firehoseiface.FirehoseAPI
+	DeliveryStream string
+}
+
+// NewFirehose creates a writer to the delivery stream.
+func NewFirehose(client firehoseiface.FirehoseAPI, deliveryStream string) *Firehose {
+	return &Firehose{
+		Client:         client,
+		DeliveryStream: deliveryStream,
+	}
+}
+
+// Write sends the events to the delivery stream. Records rejected by the
+// stream, for example when throttled, are resent a couple of times.
+func (f *Firehose) Write(ctx context.Context, events []ddblock.AuditEvent) error {
+	records := make([]*firehose.Record, 0, len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, &firehose.Record{Data: append(data, '\n')})
+	}
+
+	for len(records) > 0 {
+		n := len(records)
+		if n > firehoseMaxRecords {
+			n = firehoseMaxRecords
+		}
+
+		if err := f.put(ctx, records[:n]); err != nil {
+			return err
+		}
+
+		records = records[n:]
+	}
+
+	return nil
+}
+
+func (f *Firehose) put(ctx context.Context, records []*firehose.Record) error {
+	for attempt := 1; ; attempt++ {
+		resp, err := f.Client.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: &f.DeliveryStream,
+			Records:            records,
+		})
+		if err != nil {
+			return err
+		}
+
+		if aws.Int64Value(resp.FailedPutCount) == 0 {
+			return nil
+		}
+
+		var (
+			failed  []*firehose.Record
+			message string
+		)
+		for i, r := range resp.RequestResponses {
+			if r.ErrorCode != nil {
+				failed = append(failed, records[i])
+				message = aws.StringValue(r.ErrorMessage)
+			}
+		}
+
+		if attempt == firehoseAttempts {
+			return fmt.Errorf("ddblock/audit: %d records rejected by %s: %s", len(failed), f.DeliveryStream, message)
+		}
+
+		records = failed
+	}
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultNotifyTimeout limits how long sending one notification may take.
+var DefaultNotifyTimeout = 10 * time.Second
+
+// Notifier sends a single event, for example to page whoever is on call.
+type Notifier interface {
+	Notify(ctx context.Context, e ddblock.AuditEvent) error
+}
+
+// LossAlert is a ddblock.Auditor that sends a notification the moment a
+// lock is lost or force released, since the critical section may have
+// overlapped with another holder. Other events are ignored. Notifications
+// are sent right away in the background, not batched.
+type LossAlert struct {
+	Notifier Notifier
+	Timeout  time.Duration
+
+	// OnError, if set, is called if a notification could not be sent.
+	// If not set errors are logged with the Logger.
+	OnError func(err error, e ddblock.AuditEvent)
+
+	// Logger defaults to ddblock.DefaultLogger.
+	Logger ddblock.Logger
+}
+
+// NewLossAlert creates an alert sending with the notifier.
+func NewLossAlert(n Notifier) *LossAlert {
+	return &LossAlert{
+		Notifier: n,
+		Timeout:  DefaultNotifyTimeout,
+	}
+}
+
+// Audit sends the event if it is a loss.
+func (a *LossAlert) Audit(e ddblock.AuditEvent) {
+	if e.Action != ddblock.AuditLost && e.Action != ddblock.AuditForceRelease {
+		return
+	}
+
+	go a.send(e)
+}
+
+func (a *LossAlert) send(e ddblock.AuditEvent) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNotifyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := a.Notifier.Notify(ctx, e)
+	if err == nil {
+		return
+	}
+
+	if a.OnError != nil {
+		a.OnError(err, e)
+	} else {
+		logger(a.Logger).Error("ddblock/audit: notifying", "lock", e.Name, "action", e.Action, "error", err)
+	}
+}
+
+// SNS publishes the event as JSON to a topic.
+type SNS struct {
+	Client   snsiface.SNSAPI
+	TopicARN string
+}
+
+// NewSNS creates a notifier publishing to the topic.
+func NewSNS(client snsiface.SNSAPI, topicARN string) *SNS {
+	return &SNS{
+		Client:   client,
+		TopicARN: topicARN,
+	}
+}
+
+// Notify publishes the event.
+func (n *SNS) Notify(ctx context.Context, e ddblock.AuditEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("ddblock: %s %s", e.Name, e.Action)
+	if len(subject) > 100 {
+		// the limit of sns subjects
+		subject = subject[:100]
+	}
+
+	message := string(data)
+	_, err = n.Client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: &n.TopicARN,
+		Subject:  &subject,
+		Message:  &message,
+	})
+	return err
+}
+
+// Webhook posts the event as JSON to a URL.
+type Webhook struct {
+	URL string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewWebhook creates a notifier posting to the url.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL: url,
+	}
+}
+
+// Notify posts the event. Any status but 2xx is an error.
+func (n *Webhook) Notify(ctx context.Context, e ddblock.AuditEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ddblock/audit: webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
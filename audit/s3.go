@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// S3 writes each batch of events as an object of newline delimited JSON.
+// Objects are keyed by the hour of the first event, Prefix/YYYY/MM/DD/HH/,
+// so they can be queried by Athena with partition projection.
+type S3 struct {
+	Client s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+// NewS3 creates a writer to the bucket with the key prefix.
+func NewS3(client s3iface.S3API, bucket, prefix string) *S3 {
+	return &S3{
+		Client: client,
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+}
+
+// Write puts the events as one new object.
+func (w *S3) Write(ctx context.Context, events []ddblock.AuditEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	t := events[0].Time.UTC()
+	key := fmt.Sprintf("%s%s/%d-%016x.jsonl", w.Prefix, t.Format("2006/01/02/15"), t.UnixNano(), rand.Uint64())
+
+	_, err := w.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &w.Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
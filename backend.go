@@ -0,0 +1,153 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backend stores locks somewhere other than DynamoDB. A lease is stored as
+// a LockInfo identified by its Name, the Attributes field is not used.
+// Implementations must be safe for concurrent use and make each operation
+// atomic. ErrConflict is returned when a conditional write fails.
+type Backend interface {
+	// Put stores the lease if the lock is free, its current lease expired
+	// before the cutoff or has the same UUID. The replaced expired lease
+	// of another holder is returned, if any, or ErrConflict if the lock
+	// is held by someone else.
+	Put(ctx context.Context, lease *LockInfo, cutoff time.Time) (*LockInfo, error)
+
+	// Renew replaces the lease if the stored one has the same UUID,
+	// expired or not, otherwise ErrConflict is returned.
+	Renew(ctx context.Context, lease *LockInfo) error
+
+	// Delete removes the lease of the named lock if it has the UUID,
+	// otherwise ErrConflict is returned, also if there is no lease.
+	Delete(ctx context.Context, name, uuid string) error
+
+	// Get returns the lease of the named lock, expired or not,
+	// or nil if there is none.
+	Get(ctx context.Context, name string) (*LockInfo, error)
+}
+
+// WithBackend stores the lock in the backend instead of DynamoDB. The
+// TableName and client are not used. Features that depend on DynamoDB,
+// such as Shards, advisory mode, heirs, tombstones, sessions and
+// WaitOnStream, are not available.
+func WithBackend(b Backend) Option {
+	return func(m *Mutex) {
+		m.backend = b
+	}
+}
+
+// lease returns the lease held by this mutex expiring at the given time.
+// Must be called with m.lk held.
+func (m *Mutex) lease(expires time.Time) *LockInfo {
+	return &LockInfo{
+		Name:         m.fullname,
+		UUID:         m.uuid,
+		Expires:      expires,
+		Owner:        m.owner,
+		Payload:      m.payload,
+		Reason:       m.Reason,
+		Metadata:     m.Metadata,
+		SteppingDown: m.steppingDown,
+	}
+}
+
+// backendCreate takes the lock in the backend. Must be called with m.lk held.
+func (m *Mutex) backendCreate() error {
+	now := time.Now()
+	ttl := m.cleanTTL()
+
+	start := time.Now()
+	previous, err := m.backend.Put(m.ctx, m.lease(now.Add(ttl)), now.Add(-m.Grace))
+	m.trace(OpAcquire, start, err)
+	if err != nil {
+		if IsAquireError(err) {
+			m.recordConflict(now, nil)
+			return &ConflictError{Err: err}
+		}
+
+		return err
+	}
+
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+
+	m.previous = previous
+	if previous != nil {
+		m.logTakeover()
+		m.audit(AuditSteal, previous)
+	} else {
+		m.audit(AuditAcquire, nil)
+	}
+
+	return nil
+}
+
+// backendUpdate renews the lease in the backend. Must be called with m.lk held.
+func (m *Mutex) backendUpdate() error {
+	now := time.Now()
+	ttl := m.renewalTTL()
+
+	start := time.Now()
+	err := m.backend.Renew(m.ctx, m.lease(now.Add(ttl)))
+	m.trace(OpRenew, start, err)
+	if IsAquireError(err) {
+		m.audit(AuditLost, nil)
+		m.loseLease(ErrLockLost)
+		return ErrLockLost
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+
+	return nil
+}
+
+// backendDelete releases the lease in the backend. Must be called with m.lk held.
+func (m *Mutex) backendDelete(ownership Ownership) (Ownership, error) {
+	// the context has been canceled by Unlock
+	ctx := context.Background()
+	uuid := m.uuid
+
+	start := time.Now()
+	err := m.backend.Delete(ctx, m.fullname, uuid)
+	m.trace(OpRelease, start, err)
+	if IsAquireError(err) {
+		lease, err := m.backend.Get(ctx, m.fullname)
+		if err != nil {
+			return ownership, err
+		}
+
+		if lease != nil && lease.UUID != uuid {
+			m.audit(AuditLost, nil)
+			m.loseLease(ErrLockLost)
+			return Taken, ErrLockLost
+		}
+
+		if ownership == Intact {
+			m.audit(AuditForceRelease, nil)
+		} else {
+			m.audit(AuditRelease, nil)
+		}
+
+		m.clearLease()
+		return Expired, nil
+	}
+
+	if err != nil {
+		if !m.queueRelease(func() error { return m.backend.Delete(ctx, m.fullname, uuid) }) {
+			return ownership, err
+		}
+	}
+
+	m.audit(AuditRelease, nil)
+	m.clearLease()
+	return ownership, nil
+}
@@ -0,0 +1,194 @@
+package ddblock
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+
+	"golang.org/x/net/context"
+)
+
+// Client creates mutexes, inspectors, sequencers and semaphores that share dynamodb
+// clients and configuration, so different locks can use different regions,
+// credentials or endpoints. The package level functions use a client with
+// the defaults. Fields must not be changed while the client is in use.
+type Client struct {
+	DynamoDB dynamodbiface.DynamoDBAPI
+
+	// Streams is used with WaitOnStream and to watch locks. It must be
+	// for the same region as the DynamoDB client.
+	Streams dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	TableName string
+	Prefix    string
+	TTL       time.Duration
+	Policy    *ClientPolicy
+	Limit     *HoldLimit
+
+	// RetryInterval and Grace, if set, replace DefaultRetryInterval and
+	// DefaultGrace for the client's mutexes and WaitUnlocked.
+	RetryInterval time.Duration
+	Grace         time.Duration
+
+	// Schema names the attributes of the items, DefaultSchema if nil.
+	Schema *Schema
+
+	// NamespaceTables maps namespaces to the table storing their
+	// locks, see Namespace. Others use the TableName.
+	NamespaceTables map[string]string
+}
+
+// NewClient creates a client for the dynamodb table in the session's
+// region, with the default configuration.
+func NewClient(sess *session.Session, tableName string) *Client {
+	c := defaultClient()
+	c.DynamoDB = dynamodb.New(sess)
+	c.Streams = dynamodbstreams.New(sess)
+	if tableName != "" {
+		c.TableName = tableName
+	}
+
+	return c
+}
+
+// defaultClient returns a client with the defaults, using the
+// default dynamodb clients when it is used.
+func defaultClient() *Client {
+	return &Client{
+		TableName: DefaultTableName,
+		Prefix:    DefaultPrefix,
+		TTL:       DefaultTTL,
+		Policy:    DefaultClientPolicy,
+	}
+}
+
+// New creates a mutex with the client's configuration, then the options.
+func (c *Client) New(ctx context.Context, name string, opts ...Option) *Mutex {
+	return New(ctx, name, append([]Option{c.options}, opts...)...)
+}
+
+func (c *Client) options(m *Mutex) {
+	m.svc = c.DynamoDB
+	m.streams = c.Streams
+	m.TableName = c.TableName
+	m.Schema = c.Schema
+	m.fullname = c.Prefix + m.name
+	m.Policy = c.Policy
+	m.Limit = c.Limit
+
+	if c.TTL > 0 {
+		m.TTL = c.TTL
+	}
+
+	if c.RetryInterval > 0 {
+		m.RetryInterval = c.RetryInterval
+	}
+
+	if c.Grace > 0 {
+		m.Grace = c.Grace
+	}
+}
+
+// NewInspector creates an inspector of the client's locks.
+func (c *Client) NewInspector() *Inspector {
+	return &Inspector{
+		TableName: c.TableName,
+		Prefix:    c.Prefix,
+		Schema:    c.Schema,
+		svc:       c.DynamoDB,
+		streams:   c.Streams,
+	}
+}
+
+// NewSequencer creates a ticket lock with the client's configuration.
+func (c *Client) NewSequencer(name string) *Sequencer {
+	s := NewSequencer(name)
+	s.TableName = c.TableName
+	s.Schema = c.Schema
+	s.fullname = c.Prefix + name
+	s.svc = c.DynamoDB
+
+	if c.TTL > 0 {
+		s.TTL = c.TTL
+	}
+
+	return s
+}
+
+// NewSemaphore creates a semaphore with the client's configuration.
+func (c *Client) NewSemaphore(name string, permits int64) *Semaphore {
+	s := NewSemaphore(name, permits)
+	s.TableName = c.TableName
+	s.Schema = c.Schema
+	s.fullname = c.Prefix + name
+	s.svc = c.DynamoDB
+
+	if c.TTL > 0 {
+		s.TTL = c.TTL
+	}
+
+	return s
+}
+
+func (c *Client) db() dynamodbiface.DynamoDBAPI {
+	if c.DynamoDB != nil {
+		return c.DynamoDB
+	}
+
+	return getSvc()
+}
+
+// ForceRelease frees the named lock, whoever holds it, for operators
+// clearing a stuck lock. The item is replaced by a tombstone recording the
+// reason. The release must be allowed by the Policy, which may require the
+// reason. The holder finds the lock lost on its next renewal, so its
+// critical section may overlap with a new holder's.
+func (c *Client) ForceRelease(ctx context.Context, name, reason string) error {
+	if err := c.Policy.check(AuditForceRelease, name, reason); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	item := c.Schema.key(c.Prefix + name)
+	item[c.Schema.expiresName()] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(now.UnixNano(), 10)),
+	}
+	item[releasedAtString] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(now.UnixNano(), 10)),
+	}
+	item[ttlString] = ttlAttribute(now)
+	if c.Schema.expiryIndex() != "" {
+		item[expiryPartitionString] = &dynamodb.AttributeValue{S: aws.String(expiryPartition)}
+	}
+
+	if reason != "" {
+		item[reasonString] = &dynamodb.AttributeValue{S: aws.String(reason)}
+	}
+
+	_, err := c.db().PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           &c.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#name)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String(c.Schema.keyName()),
+		},
+	})
+	if IsAquireError(err) {
+		// nothing to release
+		return nil
+	}
+
+	return wrapError(err)
+}
+
+// ForceRelease frees the named lock, in the DefaultTableName with the
+// DefaultPrefix, using the default client. See Client.ForceRelease.
+func ForceRelease(ctx context.Context, name, reason string) error {
+	return defaultClient().ForceRelease(ctx, name, reason)
+}
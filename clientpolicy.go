@@ -0,0 +1,124 @@
+package ddblock
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+var reasonString = "reason"
+
+var (
+	// ErrReasonRequired is returned when acquiring or force releasing a lock
+	// without a reason while the ClientPolicy requires one.
+	ErrReasonRequired = errors.New("ddbmutex: a reason is required for this lock")
+
+	// ErrTTLTooLong is returned when acquiring a lock with a TTL,
+	// or extending a lease, above the MaxTTL of the ClientPolicy.
+	ErrTTLTooLong = errors.New("ddbmutex: ttl above the maximum allowed")
+
+	// ErrNameNotAllowed is returned when acquiring or force releasing a lock
+	// whose name does not match the AllowedNames of the ClientPolicy.
+	ErrNameNotAllowed = errors.New("ddbmutex: lock name not allowed")
+)
+
+// ClientPolicy are guardrails for the use of a shared lock table, set by the
+// platform team on every mutex of a client, or all with DefaultClientPolicy.
+type ClientPolicy struct {
+	// RequireReason requires a Reason, stored on the item, for acquisitions
+	// and force releases, so every lock in the console explains why it
+	// exists. If ReasonPrefixes is set it only applies to lock names
+	// starting with one of them.
+	RequireReason  bool
+	ReasonPrefixes []string
+
+	// MaxTTL, if set, is the longest TTL a lock may be acquired with.
+	MaxTTL time.Duration
+
+	// AllowedNames, if set, are the path.Match patterns, such as "billing-*",
+	// one of which lock names must match.
+	AllowedNames []string
+
+	// Authorize, if set, is consulted before every acquisition, with
+	// AuditAcquire, and force release, with AuditForceRelease. A non-nil
+	// error denies it and is returned to the caller.
+	Authorize func(action AuditAction, name, reason string) error
+}
+
+// check returns an error if the action on the lock is not allowed.
+func (p *ClientPolicy) check(action AuditAction, name, reason string) error {
+	if p == nil {
+		return nil
+	}
+
+	if reason == "" && p.requiresReason(name) {
+		return ErrReasonRequired
+	}
+
+	if len(p.AllowedNames) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowedNames {
+			if ok, _ := path.Match(pattern, name); ok {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return ErrNameNotAllowed
+		}
+	}
+
+	if p.Authorize != nil {
+		return p.Authorize(action, name, reason)
+	}
+
+	return nil
+}
+
+// DefaultClientPolicy is used by mutexes that do not set a Policy.
+var DefaultClientPolicy *ClientPolicy
+
+// requiresReason returns true if the lock name needs a reason.
+func (p *ClientPolicy) requiresReason(name string) bool {
+	if p == nil || !p.RequireReason {
+		return false
+	}
+
+	if len(p.ReasonPrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.ReasonPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policy returns the client policy of the mutex.
+func (m *Mutex) policy() *ClientPolicy {
+	if m.Policy != nil {
+		return m.Policy
+	}
+
+	return DefaultClientPolicy
+}
+
+// checkPolicy returns an error if acquiring the lock is not allowed.
+// Must be called with m.lk held.
+func (m *Mutex) checkPolicy() error {
+	p := m.policy()
+	if p == nil {
+		return nil
+	}
+
+	if p.MaxTTL > 0 && m.cleanTTL() > p.MaxTTL {
+		return ErrTTLTooLong
+	}
+
+	return p.check(AuditAcquire, m.name, m.Reason)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// tableFlags adds the flags selecting the lock table to the flag set.
+func tableFlags(fs *flag.FlagSet) *ddblock.Client {
+	c := &ddblock.Client{
+		Policy: ddblock.DefaultClientPolicy,
+	}
+
+	fs.StringVar(&c.TableName, "table", ddblock.DefaultTableName, "lock table name")
+	fs.StringVar(&c.Prefix, "prefix", ddblock.DefaultPrefix, "lock item name prefix")
+	return c
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	c := tableFlags(fs)
+	all := fs.Bool("all", false, "include expired and released locks")
+	fs.Parse(args)
+
+	locks, err := c.NewInspector().ListLocks(context.Background())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tEXPIRES\tOWNER\tUUID\tREASON")
+	for _, l := range locks {
+		state := lockState(l, now)
+		if state != "held" && !*all {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			strings.TrimPrefix(l.Name, c.Prefix), state,
+			l.Expires.Format(time.RFC3339), owner(l.Owner), l.UUID, l.Reason)
+	}
+
+	return w.Flush()
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	c := tableFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ddblock inspect [flags] <name>\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l, err := c.NewInspector().GetLockInfo(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if l == nil {
+		return fmt.Errorf("lock %s not found", fs.Arg(0))
+	}
+
+	now := time.Now()
+	data, err := json.MarshalIndent(struct {
+		*ddblock.LockInfo
+		State     string
+		ExpiresIn string
+		Payload   string `json:",omitempty"`
+	}{
+		LockInfo:  l,
+		State:     lockState(l, now),
+		ExpiresIn: l.Expires.Sub(now).Round(time.Millisecond).String(),
+		Payload:   string(l.Payload),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func forceUnlock(args []string) error {
+	fs := flag.NewFlagSet("force-unlock", flag.ExitOnError)
+	c := tableFlags(fs)
+	reason := fs.String("reason", "", "why the lock is released, recorded on the tombstone")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ddblock force-unlock -reason <reason> [flags] <name>\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return c.ForceRelease(context.Background(), fs.Arg(0), *reason)
+}
+
+// owner returns a short description of who holds the lock.
+func owner(o *ddblock.Owner) string {
+	switch {
+	case o == nil:
+		return ""
+	case o.Name != "":
+		return o.Name
+	case o.Hostname != "":
+		return fmt.Sprintf("%s:%d", o.Hostname, o.PID)
+	}
+
+	return ""
+}
+
+func lockState(l *ddblock.LockInfo, now time.Time) string {
+	switch {
+	case !l.ReleasedAt.IsZero():
+		return "released"
+	case l.Expires.Before(now):
+		return "expired"
+	}
+
+	return "held"
+}
@@ -0,0 +1,96 @@
+// Command ddblock is a command line tool for working with ddblock locks.
+//
+// Usage:
+//
+//	ddblock iam-policy [flags]
+//	ddblock run -name <name> [flags] -- command [args...]
+//	ddblock list [flags]
+//	ddblock inspect [flags] <name>
+//	ddblock force-unlock -reason <reason> [flags] <name>
+//
+// Run takes the lock, like flock, and runs the command while renewing the
+// lease, so a cron job scheduled on many hosts runs on only one at a time.
+// The lock is released when the command exits and the exit code is passed
+// through. If the lock is lost the command is sent SIGTERM.
+//
+// List, inspect and force-unlock are for operators debugging stuck locks.
+// Force-unlock replaces the lock item by a tombstone with the reason, the
+// holder finds the lock lost on its next renewal.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/paulmach/ddblock"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "iam-policy":
+		err = iamPolicy(os.Args[2:])
+	case "run":
+		err = run(os.Args[2:])
+	case "list":
+		err = list(os.Args[2:])
+	case "inspect":
+		err = inspect(os.Args[2:])
+	case "force-unlock":
+		err = forceUnlock(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if code, ok := err.(exitCode); ok {
+		os.Exit(int(code))
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ddblock: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ddblock <command> [flags]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  iam-policy    print the least privilege IAM policy for the lock table\n")
+	fmt.Fprintf(os.Stderr, "  run           run a command while holding a lock\n")
+	fmt.Fprintf(os.Stderr, "  list          list the held locks\n")
+	fmt.Fprintf(os.Stderr, "  inspect       print the holder and expiry of a lock\n")
+	fmt.Fprintf(os.Stderr, "  force-unlock  release a lock whoever holds it\n")
+	os.Exit(2)
+}
+
+func iamPolicy(args []string) error {
+	var cfg ddblock.PolicyConfig
+
+	fs := flag.NewFlagSet("iam-policy", flag.ExitOnError)
+	fs.StringVar(&cfg.TableName, "table", ddblock.DefaultTableName, "lock table name")
+	fs.StringVar(&cfg.Region, "region", "", "table region, any if empty")
+	fs.StringVar(&cfg.AccountID, "account", "", "table account id, any if empty")
+	fs.StringVar(&cfg.Partition, "partition", "aws", "aws partition")
+	fs.StringVar(&cfg.IndexName, "index", "", "index to allow querying")
+	fs.StringVar(&cfg.Prefix, "prefix", ddblock.DefaultPrefix, "restrict access to items with this name prefix, none if empty")
+	fs.BoolVar(&cfg.ReadOnly, "read-only", false, "only allow reading locks, for inspection tools")
+	fs.BoolVar(&cfg.Shards, "shards", false, "allow the batch writes used for shard items")
+	fs.BoolVar(&cfg.Updates, "updates", false, "allow the item updates used by advisory locks, semaphores and sequencers")
+	fs.BoolVar(&cfg.Transactions, "transactions", false, "allow the condition checks of writes made only by the holder")
+	fs.BoolVar(&cfg.Streams, "streams", false, "allow reading the table's stream")
+	fs.BoolVar(&cfg.CreateTable, "create-table", false, "allow creating and configuring the table")
+	fs.Parse(args)
+
+	policy, err := ddblock.IAMPolicy(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(policy))
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// exitCode makes main exit with the code of the child process.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	name := fs.String("name", "", "lock name, required")
+	ttl := fs.Duration("ttl", ddblock.DefaultTTL, "lease duration, renewed while the command runs")
+	table := fs.String("table", ddblock.DefaultTableName, "lock table name")
+	prefix := fs.String("prefix", ddblock.DefaultPrefix, "lock item name prefix")
+	wait := fs.Duration("wait", 0, "how long to wait for the lock, fail right away if zero")
+	conflict := fs.Int("conflict-exit-code", 1, "exit code if the lock is held by someone else")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ddblock run -name <name> [flags] -- command [args...]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *name == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := ddblock.New(ctx, *name,
+		ddblock.WithTableName(*table),
+		ddblock.WithPrefix(*prefix),
+		ddblock.WithTTL(*ttl),
+	)
+
+	var err error
+	if *wait > 0 {
+		wctx, wcancel := context.WithTimeout(ctx, *wait)
+		_, err = m.LockWait(wctx)
+		wcancel()
+		if err == context.DeadlineExceeded {
+			err = ddblock.ErrConflict
+		}
+	} else {
+		err = m.TryLock()
+	}
+
+	if ddblock.IsAquireError(err) {
+		var e *ddblock.ConflictError
+		if errors.As(err, &e) && e.Holder != nil {
+			fmt.Fprintf(os.Stderr, "ddblock: lock %s is held by %s for another %s\n",
+				*name, e.Holder.UUID, e.ExpiresIn().Round(time.Second))
+		} else {
+			fmt.Fprintf(os.Stderr, "ddblock: lock %s is held by someone else\n", *name)
+		}
+
+		return exitCode(*conflict)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer m.Unlock()
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// forward signals so the child can shut down, the lock is released after
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	lost := m.Lost()
+	for {
+		select {
+		case sig := <-signals:
+			cmd.Process.Signal(sig)
+		case <-lost:
+			// someone else may be running the command now, stop ours
+			fmt.Fprintf(os.Stderr, "ddblock: lock %s lost: %v\n", *name, m.Err())
+			cmd.Process.Signal(syscall.SIGTERM)
+
+			select {
+			case <-done:
+			case <-time.After(*ttl):
+				cmd.Process.Kill()
+				<-done
+			}
+
+			return exitCode(*conflict)
+		case err := <-done:
+			var e *exec.ExitError
+			if errors.As(err, &e) {
+				return exitCode(e.ExitCode())
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package conformance validates ddblock.Backend implementations, like the
+// nettest package does for net.Conn. Call Run from a test of the backend:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func() ddblock.Backend {
+//			return memory.New()
+//		})
+//	}
+//
+// Each subtest uses its own lock names, the backend may be shared.
+package conformance
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// TTL is the lease used by the tests that wait for an expiry.
+// Increase it for backends that round expiries, to seconds for example.
+var TTL = 2 * time.Second
+
+var seq int64
+
+// name returns a lock name unique to this run.
+func name() string {
+	return fmt.Sprintf("conformance-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&seq, 1))
+}
+
+func lease(name, uuid string, ttl time.Duration) *ddblock.LockInfo {
+	return &ddblock.LockInfo{
+		Name:    name,
+		UUID:    uuid,
+		Expires: time.Now().Add(ttl),
+		Reason:  "conformance",
+
+		Metadata: map[string]string{"suite": "conformance"},
+	}
+}
+
+// Run runs the conformance tests against backends returned by newBackend.
+func Run(t *testing.T, newBackend func() ddblock.Backend) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, ddblock.Backend)
+	}{
+		{"Acquire", testAcquire},
+		{"Contention", testContention},
+		{"Reacquire", testReacquire},
+		{"Expiry", testExpiry},
+		{"Renew", testRenew},
+		{"RenewLost", testRenewLost},
+		{"Delete", testDelete},
+		{"Get", testGet},
+		{"Concurrent", testConcurrent},
+		{"Mutex", testMutex},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newBackend())
+		})
+	}
+}
+
+func testAcquire(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	previous, err := b.Put(ctx, lease(n, "a", time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	if previous != nil {
+		t.Errorf("put on a free lock returned a previous lease: %+v", previous)
+	}
+}
+
+func testContention(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	if _, err := b.Put(ctx, lease(n, "a", time.Minute), time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	_, err := b.Put(ctx, lease(n, "b", time.Minute), time.Now())
+	if !ddblock.IsAquireError(err) {
+		t.Errorf("put on a held lock: expected a conflict, got %v", err)
+	}
+}
+
+func testReacquire(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	if _, err := b.Put(ctx, lease(n, "a", time.Minute), time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	previous, err := b.Put(ctx, lease(n, "a", time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("put by the same holder: %v", err)
+	}
+
+	if previous != nil {
+		t.Errorf("put by the same holder returned a previous lease: %+v", previous)
+	}
+}
+
+func testExpiry(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	a := lease(n, "a", TTL)
+	if _, err := b.Put(ctx, a, time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	time.Sleep(TTL + TTL/2)
+
+	// the cutoff is the end of a grace period, an expired lease is kept
+	// until the cutoff is after its expiry
+	if _, err := b.Put(ctx, lease(n, "c", time.Minute), a.Expires.Add(-TTL/4)); !ddblock.IsAquireError(err) {
+		t.Errorf("put within the grace period: expected a conflict, got %v", err)
+	}
+
+	previous, err := b.Put(ctx, lease(n, "b", time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("put on an expired lock: %v", err)
+	}
+
+	if previous == nil || previous.UUID != "a" {
+		t.Errorf("put on an expired lock: expected the previous lease of a, got %+v", previous)
+	}
+}
+
+func testRenew(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	if _, err := b.Put(ctx, lease(n, "a", TTL), time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	renewed := lease(n, "a", time.Hour)
+	if err := b.Renew(ctx, renewed); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	time.Sleep(TTL + TTL/2)
+
+	if _, err := b.Put(ctx, lease(n, "b", time.Minute), time.Now()); !ddblock.IsAquireError(err) {
+		t.Errorf("put on a renewed lock: expected a conflict, got %v", err)
+	}
+
+	current, err := b.Get(ctx, n)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if current == nil || current.Expires.Before(renewed.Expires.Add(-time.Second)) {
+		t.Errorf("get: expected the renewed expiry %v, got %+v", renewed.Expires, current)
+	}
+}
+
+func testRenewLost(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	if err := b.Renew(ctx, lease(n, "a", time.Minute)); !ddblock.IsAquireError(err) {
+		t.Errorf("renew of a free lock: expected a conflict, got %v", err)
+	}
+
+	if _, err := b.Put(ctx, lease(n, "a", TTL), time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	time.Sleep(TTL + TTL/2)
+
+	if _, err := b.Put(ctx, lease(n, "b", time.Minute), time.Now()); err != nil {
+		t.Fatalf("put on an expired lock: %v", err)
+	}
+
+	if err := b.Renew(ctx, lease(n, "a", time.Minute)); !ddblock.IsAquireError(err) {
+		t.Errorf("renew of a taken lock: expected a conflict, got %v", err)
+	}
+}
+
+func testDelete(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	if err := b.Delete(ctx, n, "a"); !ddblock.IsAquireError(err) {
+		t.Errorf("delete of a free lock: expected a conflict, got %v", err)
+	}
+
+	if _, err := b.Put(ctx, lease(n, "a", time.Minute), time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	if err := b.Delete(ctx, n, "b"); !ddblock.IsAquireError(err) {
+		t.Errorf("delete by another: expected a conflict, got %v", err)
+	}
+
+	if err := b.Delete(ctx, n, "a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, err := b.Put(ctx, lease(n, "b", time.Minute), time.Now()); err != nil {
+		t.Errorf("put on a deleted lock: %v", err)
+	}
+}
+
+func testGet(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	current, err := b.Get(ctx, n)
+	if err != nil {
+		t.Fatalf("get of a free lock: %v", err)
+	}
+
+	if current != nil {
+		t.Errorf("get of a free lock: expected nil, got %+v", current)
+	}
+
+	l := lease(n, "a", time.Minute)
+	l.Payload = []byte(`{"job":1}`)
+	if _, err := b.Put(ctx, l, time.Now()); err != nil {
+		t.Fatalf("put on a free lock: %v", err)
+	}
+
+	current, err = b.Get(ctx, n)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if current == nil || current.Name != n || current.UUID != "a" {
+		t.Fatalf("get: expected the lease of a, got %+v", current)
+	}
+
+	if string(current.Payload) != string(l.Payload) || current.Reason != l.Reason {
+		t.Errorf("get: payload and reason not stored, got %+v", current)
+	}
+
+	if current.Metadata["suite"] != l.Metadata["suite"] {
+		t.Errorf("get: metadata not stored, got %+v", current.Metadata)
+	}
+}
+
+func testConcurrent(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	var (
+		wg   sync.WaitGroup
+		won  int64
+		errs = make(chan error, 10)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := b.Put(ctx, lease(n, fmt.Sprintf("holder-%d", i), time.Minute), time.Now())
+			if err == nil {
+				atomic.AddInt64(&won, 1)
+			} else if !ddblock.IsAquireError(err) {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent put: %v", err)
+	}
+
+	if won != 1 {
+		t.Errorf("concurrent put: expected one holder, got %d", won)
+	}
+}
+
+func testMutex(t *testing.T, b ddblock.Backend) {
+	ctx := context.Background()
+	n := name()
+
+	m1 := ddblock.New(ctx, n, ddblock.WithBackend(b), ddblock.WithTTL(TTL))
+	m2 := ddblock.New(ctx, n, ddblock.WithBackend(b), ddblock.WithTTL(TTL))
+
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := m1.Verify(ctx); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	// the lease is renewed in the background past the ttl
+	time.Sleep(TTL + TTL/2)
+
+	if err := m2.TryLock(); !ddblock.IsAquireError(err) {
+		t.Errorf("lock of a held lock: expected a conflict, got %v", err)
+	}
+
+	if err := m1.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	if err := m2.TryLock(); err != nil {
+		t.Fatalf("lock of an unlocked lock: %v", err)
+	}
+
+	if err := m2.Unlock(); err != nil {
+		t.Errorf("unlock: %v", err)
+	}
+}
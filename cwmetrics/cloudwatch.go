@@ -0,0 +1,270 @@
+// Package cwmetrics publishes the metrics of ddblock mutexes to CloudWatch,
+// so renewal failures and contention can be alarmed on without Prometheus:
+//
+//	p := cwmetrics.NewPublisher(cloudwatch.New(sess), "MyApp/Locks")
+//	defer p.Close(ctx)
+//
+//	m := ddblock.New(ctx, "name", ddblock.WithMetrics(p))
+//
+// Values are aggregated in memory and published every Interval as
+// statistic sets, one metric per lock name and kind, with a LockName
+// dimension in addition to the publisher's Dimensions.
+package cwmetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultInterval is how often the aggregated values are published,
+// the resolution of standard CloudWatch metrics.
+var DefaultInterval = time.Minute
+
+// maxDatums is the most metric data in one PutMetricData call.
+const maxDatums = 1000
+
+// Publisher is a ddblock.Metrics publishing to CloudWatch.
+// The fields must be set before the first value is recorded.
+type Publisher struct {
+	Client    cloudwatchiface.CloudWatchAPI
+	Namespace string
+
+	// Dimensions are added to each metric, for example the service name.
+	Dimensions map[string]string
+
+	// Interval defaults to DefaultInterval.
+	Interval time.Duration
+
+	// OnError, if set, is called when publishing fails, the values are
+	// dropped. If not set errors are logged with the Logger.
+	OnError func(err error)
+
+	// Logger defaults to ddblock.DefaultLogger.
+	Logger ddblock.Logger
+
+	once    sync.Once
+	lk      sync.Mutex
+	stats   map[statKey]*stat
+	closing chan context.Context
+	stopped chan struct{}
+}
+
+var _ ddblock.Metrics = &Publisher{}
+
+type statKey struct {
+	name   string
+	metric string
+	unit   string
+}
+
+type stat struct {
+	count, sum, min, max float64
+}
+
+// NewPublisher creates a publisher to the namespace with the defaults.
+func NewPublisher(client cloudwatchiface.CloudWatchAPI, namespace string) *Publisher {
+	return &Publisher{
+		Client:    client,
+		Namespace: namespace,
+		Interval:  DefaultInterval,
+	}
+}
+
+// Acquired counts an acquisition as Acquisitions.
+func (p *Publisher) Acquired(name string) {
+	p.record(name, "Acquisitions", cloudwatch.StandardUnitCount, 1)
+}
+
+// Conflict counts an acquisition that found the lock held as Conflicts.
+func (p *Publisher) Conflict(name string) {
+	p.record(name, "Conflicts", cloudwatch.StandardUnitCount, 1)
+}
+
+// Renewed counts a renewal as Renewals.
+func (p *Publisher) Renewed(name string) {
+	p.record(name, "Renewals", cloudwatch.StandardUnitCount, 1)
+}
+
+// RenewFailed counts a failed renewal as RenewFailures.
+func (p *Publisher) RenewFailed(name string, err error) {
+	p.record(name, "RenewFailures", cloudwatch.StandardUnitCount, 1)
+}
+
+// Released counts a release as Releases and records the HoldTime.
+func (p *Publisher) Released(name string, held time.Duration) {
+	p.record(name, "Releases", cloudwatch.StandardUnitCount, 1)
+	if held > 0 {
+		p.record(name, "HoldTime", cloudwatch.StandardUnitSeconds, held.Seconds())
+	}
+}
+
+// Latency records the duration of the operation as, for example, AcquireLatency.
+func (p *Publisher) Latency(name string, op ddblock.Op, d time.Duration, err error) {
+	var metric string
+	switch op {
+	case ddblock.OpAcquire:
+		metric = "AcquireLatency"
+	case ddblock.OpRenew:
+		metric = "RenewLatency"
+	case ddblock.OpRelease:
+		metric = "ReleaseLatency"
+	default:
+		return
+	}
+
+	p.record(name, metric, cloudwatch.StandardUnitMilliseconds, float64(d)/float64(time.Millisecond))
+}
+
+// Close publishes the remaining values and stops publishing.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.start()
+
+	select {
+	case p.closing <- ctx:
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Publisher) record(name, metric, unit string, v float64) {
+	p.start()
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	k := statKey{name: name, metric: metric, unit: unit}
+	s := p.stats[k]
+	if s == nil {
+		p.stats[k] = &stat{count: 1, sum: v, min: v, max: v}
+		return
+	}
+
+	s.count++
+	s.sum += v
+	if v < s.min {
+		s.min = v
+	}
+
+	if v > s.max {
+		s.max = v
+	}
+}
+
+func (p *Publisher) start() {
+	p.once.Do(func() {
+		p.stats = make(map[statKey]*stat)
+		p.closing = make(chan context.Context)
+		p.stopped = make(chan struct{})
+		go p.run()
+	})
+}
+
+func (p *Publisher) run() {
+	defer close(p.stopped)
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			p.publish(context.Background())
+		case ctx := <-p.closing:
+			p.publish(ctx)
+			return
+		}
+	}
+}
+
+// publish sends the values aggregated since the last call.
+func (p *Publisher) publish(ctx context.Context) {
+	p.lk.Lock()
+	stats := p.stats
+	p.stats = make(map[statKey]*stat)
+	p.lk.Unlock()
+
+	now := time.Now()
+	data := make([]*cloudwatch.MetricDatum, 0, len(stats))
+	for k, s := range stats {
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String(k.metric),
+			Dimensions: p.dimensions(k.name),
+			Timestamp:  &now,
+			Unit:       aws.String(k.unit),
+			StatisticValues: &cloudwatch.StatisticSet{
+				SampleCount: aws.Float64(s.count),
+				Sum:         aws.Float64(s.sum),
+				Minimum:     aws.Float64(s.min),
+				Maximum:     aws.Float64(s.max),
+			},
+		})
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxDatums {
+			n = maxDatums
+		}
+
+		_, err := p.Client.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.Namespace),
+			MetricData: data[:n],
+		})
+		if err != nil {
+			p.error(err)
+		}
+
+		data = data[n:]
+	}
+}
+
+func (p *Publisher) dimensions(name string) []*cloudwatch.Dimension {
+	dims := []*cloudwatch.Dimension{{
+		Name:  aws.String("LockName"),
+		Value: aws.String(name),
+	}}
+
+	for k, v := range p.Dimensions {
+		dims = append(dims, &cloudwatch.Dimension{
+			Name:  aws.String(k),
+			Value: aws.String(v),
+		})
+	}
+
+	return dims
+}
+
+func (p *Publisher) error(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+		return
+	}
+
+	logger := p.Logger
+	if logger == nil {
+		logger = ddblock.DefaultLogger()
+	}
+
+	logger.Error("ddblock/cwmetrics: publishing metrics", "error", err)
+}
@@ -0,0 +1,62 @@
+// Package ddbxray traces ddblock locks with AWS X-Ray. The requests to the
+// lock table appear as subsegments of the segment in the mutex's context:
+//
+//	ctx, seg := xray.BeginSegment(context.Background(), "job")
+//	defer seg.Close(nil)
+//
+//	m := ddblock.New(ctx, "name", ddbxray.WithClient(sess), ddbxray.Annotate())
+//
+// Background renewals use the context given to New, so create the mutex with
+// the context of the work it protects.
+package ddbxray
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/paulmach/ddblock"
+)
+
+// Client returns a dynamodb client for the session instrumented with X-Ray.
+func Client(sess *session.Session) *dynamodb.DynamoDB {
+	db := dynamodb.New(sess)
+	xray.AWS(db.Client)
+
+	return db
+}
+
+// WithClient uses an X-Ray instrumented dynamodb client for the lock item.
+func WithClient(sess *session.Session) ddblock.Option {
+	return ddblock.WithClient(Client(sess))
+}
+
+// Annotate records the lock name and the outcome of each operation, such
+// as ddblock_acquire=conflict, as annotations of the segment so traces can
+// be searched by them. It wraps the Trace hook set before it, if any, and
+// is subject to the Sampling.
+func Annotate() ddblock.Option {
+	return func(m *ddblock.Mutex) {
+		next := m.Trace
+		m.Trace = func(e ddblock.TraceEvent) {
+			xray.AddAnnotation(e.Context, "ddblock_lock", e.Name)
+			xray.AddAnnotation(e.Context, "ddblock_"+e.Op.String(), outcome(e))
+
+			if next != nil {
+				next(e)
+			}
+		}
+	}
+}
+
+func outcome(e ddblock.TraceEvent) string {
+	switch {
+	case e.Err == nil:
+		return "ok"
+	case e.Op == ddblock.OpAcquire && ddblock.IsAquireError(e.Err):
+		return "conflict"
+	case e.Op != ddblock.OpAcquire && ddblock.IsAquireError(e.Err):
+		return "lost"
+	}
+
+	return "error"
+}
@@ -0,0 +1,234 @@
+// Package etcdbackend stores ddblock locks in etcd, so Kubernetes native
+// deployments keep the ddblock API without a DynamoDB table:
+//
+//	cli, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(etcdbackend.New(cli)))
+//
+// Each lock is a key whose value is the JSON encoded lease, changed with
+// transactions on its mod revision. The key is attached to an etcd lease
+// that outlives the lock lease by the cleanup delay, so abandoned locks
+// are eventually deleted by etcd.
+package etcdbackend
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/paulmach/ddblock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultPrefix is added to the lock names to make the keys.
+var DefaultPrefix = "/ddblock/"
+
+// DefaultCleanupDelay is how long after a lease expires etcd deletes the key.
+// Until then the lapsed lease is returned as the previous one on takeover.
+var DefaultCleanupDelay = time.Hour
+
+// Backend is a ddblock.Backend storing locks in etcd.
+type Backend struct {
+	KV    clientv3.KV
+	Lease clientv3.Lease
+
+	// Prefix defaults to DefaultPrefix.
+	Prefix string
+
+	// CleanupDelay defaults to DefaultCleanupDelay.
+	CleanupDelay time.Duration
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates a backend using the client.
+func New(client *clientv3.Client) *Backend {
+	return &Backend{
+		KV:     client.KV,
+		Lease:  client.Lease,
+		Prefix: DefaultPrefix,
+	}
+}
+
+func (b *Backend) key(name string) string {
+	if b.Prefix == "" {
+		return DefaultPrefix + name
+	}
+
+	return b.Prefix + name
+}
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	key := b.key(lease.Name)
+	current, rev, id, err := b.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && current.UUID != lease.UUID && !current.Expires.Before(cutoff) {
+		return nil, ddblock.ErrConflict
+	}
+
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	if current != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(key), "=", rev)
+	}
+
+	reuse := current != nil && current.UUID == lease.UUID
+	if err := b.put(ctx, key, lease, cmp, id, reuse); err != nil {
+		return nil, err
+	}
+
+	if current == nil || current.UUID == lease.UUID {
+		return nil, nil
+	}
+
+	return current, nil
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	key := b.key(lease.Name)
+	current, rev, id, err := b.get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || current.UUID != lease.UUID {
+		return ddblock.ErrConflict
+	}
+
+	return b.put(ctx, key, lease, clientv3.Compare(clientv3.ModRevision(key), "=", rev), id, true)
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	key := b.key(name)
+	current, rev, id, err := b.get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || current.UUID != uuid {
+		return ddblock.ErrConflict
+	}
+
+	resp, err := b.KV.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return ddblock.ErrConflict
+	}
+
+	b.revoke(ctx, id)
+	return nil
+}
+
+// Get returns the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	lease, _, _, err := b.get(ctx, b.key(name))
+	return lease, err
+}
+
+// get returns the lease at the key, its mod revision and the etcd lease
+// the key is attached to.
+func (b *Backend) get(ctx context.Context, key string) (*ddblock.LockInfo, int64, clientv3.LeaseID, error) {
+	resp, err := b.KV.Get(ctx, key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, 0, 0, nil
+	}
+
+	kv := resp.Kvs[0]
+	lease := &ddblock.LockInfo{}
+	if err := json.Unmarshal(kv.Value, lease); err != nil {
+		return nil, 0, 0, err
+	}
+
+	return lease, kv.ModRevision, clientv3.LeaseID(kv.Lease), nil
+}
+
+// put writes the lease if the comparison holds, ErrConflict otherwise.
+// The key stays attached to the etcd lease it has, if reuse, and that
+// lease is kept alive long enough, else it moves to a new etcd lease and
+// the old one is revoked. A new etcd lease is revoked if the write fails.
+func (b *Backend) put(ctx context.Context, key string, lease *ddblock.LockInfo, cmp clientv3.Cmp, old clientv3.LeaseID, reuse bool) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	delay := b.CleanupDelay
+	if delay <= 0 {
+		delay = DefaultCleanupDelay
+	}
+
+	ttl := int64((time.Until(lease.Expires) + delay + time.Second - 1) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	id := old
+	granted := !reuse || !b.keepAlive(ctx, old, ttl)
+	if granted {
+		grant, err := b.Lease.Grant(ctx, ttl)
+		if err != nil {
+			return err
+		}
+
+		id = grant.ID
+	}
+
+	resp, err := b.KV.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpPut(key, string(data), clientv3.WithLease(id))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		if granted {
+			b.revoke(ctx, id)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return ddblock.ErrConflict
+	}
+
+	if granted {
+		b.revoke(ctx, old)
+	}
+
+	return nil
+}
+
+// keepAlive refreshes the etcd lease, true if it now lasts at least ttl
+// seconds and can be kept.
+func (b *Backend) keepAlive(ctx context.Context, id clientv3.LeaseID, ttl int64) bool {
+	if id == 0 {
+		return false
+	}
+
+	resp, err := b.Lease.KeepAliveOnce(ctx, id)
+	return err == nil && resp.TTL >= ttl
+}
+
+// revoke revokes the etcd lease, if any. A failure is ignored,
+// the lease then expires on its own.
+func (b *Backend) revoke(ctx context.Context, id clientv3.LeaseID) {
+	if id == 0 {
+		return
+	}
+
+	b.Lease.Revoke(ctx, id)
+}
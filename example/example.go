@@ -11,7 +11,7 @@ import (
 func main() {
 	m := ddblock.New(context.Background(), "foo")
 
-	err := m.Lock()
+	err := m.TryLock()
 	if ddblock.IsAquireError(err) {
 		log.Fatalf("someone already has the lock")
 	} else if err != nil {
@@ -0,0 +1,50 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Extend pushes out the expiry of the held lease by d, without changing the
+// TTL, for example when a job finds it needs more time than usual. Later
+// renewals keep the extended expiry until a TTL from the renewal reaches
+// past it. ErrNotHeld is returned if the lock is not held and ErrLockLost
+// if someone else took it. ErrTTLTooLong is returned if the extended lease
+// would be longer than the MaxTTL of the ClientPolicy.
+func (m *Mutex) Extend(ctx context.Context, d time.Duration) error {
+	m.lk.Lock()
+	if m.uuid == "" || m.renewed.IsZero() {
+		m.lk.Unlock()
+		return ErrNotHeld
+	}
+
+	if p := m.policy(); p != nil && p.MaxTTL > 0 && m.ttl+d > p.MaxTTL {
+		m.lk.Unlock()
+		return ErrTTLTooLong
+	}
+
+	previous := m.extended
+	m.extended = m.renewed.Add(m.ttl + d)
+	m.lk.Unlock()
+
+	err := m.updateContext(ctx)
+	if err != nil && err != ErrLockLost {
+		m.lk.Lock()
+		m.extended = previous
+		m.lk.Unlock()
+	}
+
+	return err
+}
+
+// renewalTTL returns the lease duration of the next renewal, the TTL or
+// longer to keep an extended expiry. Must be called with m.lk held.
+func (m *Mutex) renewalTTL() time.Duration {
+	ttl := m.cleanTTL()
+	if d := time.Until(m.extended); d > ttl {
+		ttl = d
+	}
+
+	return ttl
+}
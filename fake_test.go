@@ -0,0 +1,816 @@
+package ddblock
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"golang.org/x/net/context"
+)
+
+type fakeItem = map[string]*dynamodb.AttributeValue
+
+// fakeDB is an in memory table implementing the item operations, and the
+// condition and update expressions, used by the lock logic. Like dynamodb
+// it rejects expressions with unknown or unused names and values.
+// Calling any other method panics.
+type fakeDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	lk    sync.Mutex
+	keys  []string
+	items map[string]fakeItem
+}
+
+// newFakeDB creates an empty table with the key attributes.
+func newFakeDB(keys ...string) *fakeDB {
+	if len(keys) == 0 {
+		keys = []string{DefaultSchema.Key}
+	}
+
+	return &fakeDB{
+		keys:  keys,
+		items: make(map[string]fakeItem),
+	}
+}
+
+// put writes the item without any condition.
+func (f *fakeDB) put(it fakeItem) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	k, err := f.key(it)
+	if err != nil {
+		panic(err)
+	}
+
+	f.items[k] = copyItem(it)
+}
+
+// get returns a copy of the item with the string hash key, nil if missing.
+func (f *fakeDB) get(name string) fakeItem {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	return copyItem(f.items[name])
+}
+
+func (f *fakeDB) GetItemWithContext(ctx context.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	k, err := f.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.GetItemOutput{Item: copyItem(f.items[k])}, nil
+}
+
+func (f *fakeDB) PutItemWithContext(ctx context.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	k, err := f.key(in.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	old := f.items[k]
+	e := newExpr(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err := f.check(e, in.ConditionExpression, old, in.ReturnValuesOnConditionCheckFailure); err != nil {
+		return nil, err
+	}
+
+	f.items[k] = copyItem(in.Item)
+
+	out := &dynamodb.PutItemOutput{}
+	if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+
+	return out, nil
+}
+
+func (f *fakeDB) DeleteItemWithContext(ctx context.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	k, err := f.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	old := f.items[k]
+	e := newExpr(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err := f.check(e, in.ConditionExpression, old, in.ReturnValuesOnConditionCheckFailure); err != nil {
+		return nil, err
+	}
+
+	delete(f.items, k)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+
+	return out, nil
+}
+
+func (f *fakeDB) UpdateItemWithContext(ctx context.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	k, err := f.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	old := f.items[k]
+	e := newExpr(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	updated := copyItem(old)
+	if updated == nil {
+		updated = copyItem(in.Key)
+	}
+
+	// an update of a missing attribute only fails if the condition holds
+	var touched []string
+	updateErr := e.run(func() {
+		touched = newParser(e, aws.StringValue(in.UpdateExpression), old).update(updated)
+	})
+
+	ok, err := f.eval(e, in.ConditionExpression, old)
+	if err != nil {
+		return nil, err
+	}
+
+	if updateErr == nil {
+		if err := e.unused(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		return nil, failed(old, in.ReturnValuesOnConditionCheckFailure)
+	}
+
+	if updateErr != nil {
+		return nil, updateErr
+	}
+
+	f.items[k] = updated
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(in.ReturnValues) {
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = copyItem(old)
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = copyItem(updated)
+	case dynamodb.ReturnValueUpdatedOld, dynamodb.ReturnValueUpdatedNew:
+		from := updated
+		if aws.StringValue(in.ReturnValues) == dynamodb.ReturnValueUpdatedOld {
+			from = old
+		}
+
+		out.Attributes = make(fakeItem)
+		for _, name := range touched {
+			if v := from[name]; v != nil {
+				out.Attributes[name] = copyAttribute(v)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// ScanWithContext evaluates the items in key order, so pages are stable.
+func (f *fakeDB) ScanWithContext(ctx context.Context, in *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	keys := make([]string, 0, len(f.items))
+	for k := range f.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(in.ExclusiveStartKey) > 0 {
+		start, err := f.key(in.ExclusiveStartKey)
+		if err != nil {
+			return nil, err
+		}
+
+		i := sort.SearchStrings(keys, start)
+		if i < len(keys) && keys[i] == start {
+			i++
+		}
+		keys = keys[i:]
+	}
+
+	out := &dynamodb.ScanOutput{}
+	e := newExpr(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	limit := int(aws.Int64Value(in.Limit))
+	if limit > 0 && len(keys) >= limit {
+		// dynamodb returns the key even if it was the last item
+		keys = keys[:limit]
+		out.LastEvaluatedKey = f.keyOf(f.items[keys[limit-1]])
+	}
+
+	// resolves the references even if there are no items
+	if _, err := f.eval(e, in.FilterExpression, nil); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		ok, err := f.eval(e, in.FilterExpression, f.items[k])
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			out.Items = append(out.Items, copyItem(f.items[k]))
+		}
+	}
+
+	if err := e.unused(); err != nil {
+		return nil, err
+	}
+
+	out.Count = aws.Int64(int64(len(out.Items)))
+	return out, nil
+}
+
+func (f *fakeDB) ScanPagesWithContext(ctx context.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	params := *in
+	for {
+		page, err := f.ScanWithContext(ctx, &params, opts...)
+		if err != nil {
+			return err
+		}
+
+		last := len(page.LastEvaluatedKey) == 0
+		if !fn(page, last) || last {
+			return nil
+		}
+
+		params.ExclusiveStartKey = page.LastEvaluatedKey
+	}
+}
+
+// check evaluates the condition against the old item, returning
+// a conditional check failure if it is false.
+func (f *fakeDB) check(e *expr, cond *string, old fakeItem, returnOnFailure *string) error {
+	ok, err := f.eval(e, cond, old)
+	if err != nil {
+		return err
+	}
+
+	if err := e.unused(); err != nil {
+		return err
+	}
+
+	if !ok {
+		return failed(old, returnOnFailure)
+	}
+
+	return nil
+}
+
+// failed returns the conditional check failure, with the old item if requested.
+func failed(old fakeItem, returnOnFailure *string) error {
+	err := &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+	}
+	if aws.StringValue(returnOnFailure) == dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+		err.Item = copyItem(old)
+	}
+
+	return err
+}
+
+// eval evaluates the condition, true if there is none.
+func (f *fakeDB) eval(e *expr, cond *string, it fakeItem) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+
+	ok := false
+	err := e.run(func() {
+		ok = newParser(e, *cond, it).condition()
+	})
+
+	return ok, err
+}
+
+// key returns the key attributes of the item joined as a string,
+// which sorts like the hash key for string keys.
+func (f *fakeDB) key(it fakeItem) (string, error) {
+	parts := make([]string, 0, len(f.keys))
+	for _, k := range f.keys {
+		v := it[k]
+		if v == nil || (v.S == nil && v.N == nil) {
+			return "", awserr.New("ValidationException", "missing key attribute "+k, nil)
+		}
+
+		parts = append(parts, aws.StringValue(v.S)+aws.StringValue(v.N))
+	}
+
+	return strings.Join(parts, "\x00"), nil
+}
+
+func (f *fakeDB) keyOf(it fakeItem) fakeItem {
+	key := make(fakeItem, len(f.keys))
+	for _, k := range f.keys {
+		key[k] = copyAttribute(it[k])
+	}
+
+	return key
+}
+
+// expr resolves the names and values of an expression,
+// tracking which were used.
+type expr struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	used   map[string]bool
+}
+
+func newExpr(names map[string]*string, values map[string]*dynamodb.AttributeValue) *expr {
+	return &expr{
+		names:  names,
+		values: values,
+		used:   make(map[string]bool),
+	}
+}
+
+// exprError is the panic of an invalid expression, converted
+// into a validation exception by run.
+type exprError string
+
+func (e *expr) run(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(exprError)
+			if !ok {
+				panic(r)
+			}
+
+			err = awserr.New("ValidationException", string(msg), nil)
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+func (e *expr) name(ref string) string {
+	n, ok := e.names[ref]
+	if !ok || n == nil {
+		panic(exprError("undefined expression attribute name " + ref))
+	}
+
+	e.used[ref] = true
+	return *n
+}
+
+func (e *expr) value(ref string) *dynamodb.AttributeValue {
+	v, ok := e.values[ref]
+	if !ok || v == nil {
+		panic(exprError("undefined expression attribute value " + ref))
+	}
+
+	e.used[ref] = true
+	return v
+}
+
+// unused returns a validation exception if a name or value was not used.
+func (e *expr) unused() error {
+	for ref := range e.names {
+		if !e.used[ref] {
+			return awserr.New("ValidationException", "unused expression attribute name "+ref, nil)
+		}
+	}
+
+	for ref := range e.values {
+		if !e.used[ref] {
+			return awserr.New("ValidationException", "unused expression attribute value "+ref, nil)
+		}
+	}
+
+	return nil
+}
+
+// parser evaluates an expression against an item as it parses it.
+// Every branch is evaluated, there is no short circuit, so all the
+// references in the expression are resolved.
+type parser struct {
+	e    *expr
+	toks []string
+	pos  int
+	item fakeItem
+}
+
+func newParser(e *expr, s string, it fakeItem) *parser {
+	return &parser{e: e, toks: tokenize(s), item: it}
+}
+
+func tokenize(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(s[i:], "<>"), strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case strings.ContainsRune("()=<>,.+-[]", c):
+			toks = append(toks, s[i:i+1])
+			i++
+		default:
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '#' || s[j] == ':' ||
+				unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+
+	return toks
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	if t == "" {
+		panic(exprError("unexpected end of expression"))
+	}
+
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(t string) {
+	if got := p.next(); got != t {
+		panic(exprError(fmt.Sprintf("expected %q, got %q", t, got)))
+	}
+}
+
+func (p *parser) keyword(k string) bool {
+	if strings.EqualFold(p.peek(), k) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) condition() bool {
+	ok := p.or()
+	if p.peek() != "" {
+		panic(exprError("unexpected " + p.peek()))
+	}
+
+	return ok
+}
+
+func (p *parser) or() bool {
+	ok := p.and()
+	for p.keyword("OR") {
+		r := p.and()
+		ok = ok || r
+	}
+
+	return ok
+}
+
+func (p *parser) and() bool {
+	ok := p.not()
+	for p.keyword("AND") {
+		r := p.not()
+		ok = ok && r
+	}
+
+	return ok
+}
+
+func (p *parser) not() bool {
+	if p.keyword("NOT") {
+		return !p.not()
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() bool {
+	if p.peek() == "(" {
+		p.next()
+		ok := p.or()
+		p.expect(")")
+		return ok
+	}
+
+	switch strings.ToLower(p.peek()) {
+	case "attribute_exists", "attribute_not_exists":
+		fn := strings.ToLower(p.next())
+		p.expect("(")
+		v := p.path().get(p.item)
+		p.expect(")")
+		return (v != nil) == (fn == "attribute_exists")
+	case "begins_with":
+		p.next()
+		p.expect("(")
+		v := p.path().get(p.item)
+		p.expect(",")
+		prefix := p.operand()
+		p.expect(")")
+		return v != nil && v.S != nil && prefix.S != nil && strings.HasPrefix(*v.S, *prefix.S)
+	}
+
+	a := p.operand()
+	if p.keyword("BETWEEN") {
+		lo := p.operand()
+		if !p.keyword("AND") {
+			panic(exprError("expected AND in BETWEEN"))
+		}
+		hi := p.operand()
+		return compare(a, ">=", lo) && compare(a, "<=", hi)
+	}
+
+	op := p.next()
+	switch op {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		panic(exprError("unknown comparator " + op))
+	}
+
+	return compare(a, op, p.operand())
+}
+
+// operand is a value reference or a path, nil if the path is missing.
+func (p *parser) operand() *dynamodb.AttributeValue {
+	if strings.HasPrefix(p.peek(), ":") {
+		return p.e.value(p.next())
+	}
+
+	return p.path().get(p.item)
+}
+
+// docPath is the attribute names of a document path.
+type docPath []string
+
+func (p *parser) path() docPath {
+	var names docPath
+	for {
+		t := p.next()
+		if strings.HasPrefix(t, "#") {
+			t = p.e.name(t)
+		} else if t == "" || !(unicode.IsLetter(rune(t[0])) || t[0] == '_') {
+			panic(exprError("expected an attribute name, got " + t))
+		}
+
+		names = append(names, t)
+		if p.peek() != "." {
+			return names
+		}
+		p.next()
+	}
+}
+
+func (pa docPath) get(it fakeItem) *dynamodb.AttributeValue {
+	var v *dynamodb.AttributeValue
+	for i, name := range pa {
+		if i > 0 {
+			if v.M == nil {
+				return nil
+			}
+			it = v.M
+		}
+
+		if v = it[name]; v == nil {
+			return nil
+		}
+	}
+
+	return v
+}
+
+func (pa docPath) set(it fakeItem, v *dynamodb.AttributeValue) {
+	for _, name := range pa[:len(pa)-1] {
+		parent := it[name]
+		if parent == nil || parent.M == nil {
+			panic(exprError("the document path is invalid for update"))
+		}
+		it = parent.M
+	}
+
+	it[pa[len(pa)-1]] = v
+}
+
+func (pa docPath) remove(it fakeItem) {
+	for _, name := range pa[:len(pa)-1] {
+		parent := it[name]
+		if parent == nil || parent.M == nil {
+			return
+		}
+		it = parent.M
+	}
+
+	delete(it, pa[len(pa)-1])
+}
+
+// update applies the update expression to the item, evaluating
+// operands against the item before the update like dynamodb does.
+// It returns the top level attributes that were set or added.
+func (p *parser) update(it fakeItem) []string {
+	var (
+		touched []string
+		actions []func()
+	)
+	for p.peek() != "" {
+		clause := strings.ToUpper(p.next())
+		for {
+			pa := p.path()
+			switch clause {
+			case "SET":
+				p.expect("=")
+				v := p.setValue()
+				actions = append(actions, func() { pa.set(it, v) })
+				touched = append(touched, pa[0])
+			case "REMOVE":
+				actions = append(actions, func() { pa.remove(it) })
+			case "ADD":
+				add := p.e.value(p.next())
+				v := addNumbers(pa.get(p.item), add, "+")
+				actions = append(actions, func() { pa.set(it, v) })
+				touched = append(touched, pa[0])
+			default:
+				panic(exprError("unknown update clause " + clause))
+			}
+
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+	}
+
+	for _, a := range actions {
+		a()
+	}
+
+	return touched
+}
+
+func (p *parser) setValue() *dynamodb.AttributeValue {
+	a := p.setOperand()
+	if op := p.peek(); op == "+" || op == "-" {
+		p.next()
+		return addNumbers(a, p.setOperand(), op)
+	}
+
+	return a
+}
+
+func (p *parser) setOperand() *dynamodb.AttributeValue {
+	if strings.EqualFold(p.peek(), "if_not_exists") {
+		p.next()
+		p.expect("(")
+		v := p.path().get(p.item)
+		p.expect(",")
+		def := p.setValue()
+		p.expect(")")
+		if v == nil {
+			return def
+		}
+		return v
+	}
+
+	v := p.operand()
+	if v == nil {
+		panic(exprError("the provided expression refers to an attribute that does not exist in the item"))
+	}
+
+	return v
+}
+
+// addNumbers adds, or subtracts, two numbers. A missing a is zero.
+func addNumbers(a, b *dynamodb.AttributeValue, op string) *dynamodb.AttributeValue {
+	x, y := new(big.Rat), number(b)
+	if a != nil {
+		x = number(a)
+	}
+
+	if op == "-" {
+		x.Sub(x, y)
+	} else {
+		x.Add(x, y)
+	}
+
+	return &dynamodb.AttributeValue{N: aws.String(x.RatString())}
+}
+
+func number(v *dynamodb.AttributeValue) *big.Rat {
+	if v == nil || v.N == nil {
+		panic(exprError("an operand in the update expression has an incorrect data type"))
+	}
+
+	r, ok := new(big.Rat).SetString(*v.N)
+	if !ok {
+		panic(exprError("invalid number " + *v.N))
+	}
+
+	return r
+}
+
+// compare compares two values like dynamodb. Missing values or values of
+// different types are only not equal, strings and numbers are ordered.
+func compare(a *dynamodb.AttributeValue, op string, b *dynamodb.AttributeValue) bool {
+	var c int
+	switch {
+	case a == nil || b == nil:
+		return op == "<>"
+	case a.N != nil && b.N != nil:
+		c = number(a).Cmp(number(b))
+	case a.S != nil && b.S != nil:
+		c = strings.Compare(*a.S, *b.S)
+	default:
+		eq := reflect.DeepEqual(a, b)
+		switch op {
+		case "=":
+			return eq
+		case "<>":
+			return !eq
+		}
+
+		return false
+	}
+
+	switch op {
+	case "=":
+		return c == 0
+	case "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+
+	return c >= 0
+}
+
+func copyItem(it fakeItem) fakeItem {
+	if it == nil {
+		return nil
+	}
+
+	c := make(fakeItem, len(it))
+	for k, v := range it {
+		c[k] = copyAttribute(v)
+	}
+
+	return c
+}
+
+func copyAttribute(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+
+	c := *v
+	if v.M != nil {
+		c.M = copyItem(v.M)
+	}
+
+	if v.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			c.L[i] = copyAttribute(e)
+		}
+	}
+
+	return &c
+}
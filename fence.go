@@ -0,0 +1,176 @@
+package ddblock
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var fenceString = "fence"
+
+// Fence returns the fencing token of the current lease, with Fencing, or
+// zero if the lock is not held. A later lease of the lock has a greater
+// token, so writes made by a holder whose lease lapsed can be rejected by
+// the resources it protects, see FenceCondition.
+func (m *Mutex) Fence() int64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" || m.renewed.IsZero() {
+		return 0
+	}
+
+	return m.fence
+}
+
+// nextFence reads the token of the current lock item and sets the token of
+// the next lease, one more than it. It is at least the current time in
+// microseconds so the tokens keep increasing if the item was deleted.
+// The current token, empty if there is none, is returned for the put's
+// condition. Must be called with m.lk held.
+func (m *Mutex) nextFence() (string, error) {
+	resp, err := m.db().GetItemWithContext(m.opContext(), &dynamodb.GetItemInput{
+		TableName:      &m.TableName,
+		Key:            m.Schema.key(m.fullname),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", wrapError(err)
+	}
+
+	var current string
+	fence := time.Now().UnixNano() / int64(time.Microsecond)
+	if v := resp.Item[fenceString]; v != nil && v.N != nil {
+		current = *v.N
+		if n, err := strconv.ParseInt(current, 10, 64); err == nil && n >= fence {
+			fence = n + 1
+		}
+	}
+
+	m.fence = fence
+	return current, nil
+}
+
+// fenceCondition makes the put fail if the token of the lock item changed
+// since it was read by nextFence, so every lease gets a greater token.
+func (m *Mutex) fenceCondition(params *dynamodb.PutItemInput, current string) {
+	params.ExpressionAttributeNames["#fence"] = &fenceString
+
+	cond := "attribute_not_exists(#fence)"
+	if current != "" {
+		cond = "#fence = :fence"
+		params.ExpressionAttributeValues[":fence"] = &dynamodb.AttributeValue{N: aws.String(current)}
+	}
+
+	params.ConditionExpression = aws.String("(" + aws.StringValue(params.ConditionExpression) + ") AND " + cond)
+}
+
+// FenceCondition guards the caller's own writes with the fencing token of
+// a lease. The item's fence attribute must be missing or at most the token,
+// and the write sets it to the token, so once a later holder has written the
+// item a holder whose lease lapsed can no longer write it.
+type FenceCondition struct {
+	// Expression is the condition expression, using the Names and Values.
+	Expression string
+	Names      map[string]*string
+	Values     map[string]*dynamodb.AttributeValue
+
+	// Set is the clause of an update expression setting the fence
+	// attribute to the token, to add after SET.
+	Set string
+
+	attr  string
+	token *dynamodb.AttributeValue
+}
+
+// FenceCondition returns the condition of writes fenced by the current
+// lease, on the attr attribute of the caller's items. ErrNotHeld is
+// returned if the lock is not held with Fencing.
+func (m *Mutex) FenceCondition(attr string) (*FenceCondition, error) {
+	fence := m.Fence()
+	if fence == 0 {
+		return nil, ErrNotHeld
+	}
+
+	token := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(fence, 10))}
+	return &FenceCondition{
+		Expression: "attribute_not_exists(#ddblock_fence) OR #ddblock_fence <= :ddblock_fence",
+		Names: map[string]*string{
+			"#ddblock_fence": aws.String(attr),
+		},
+		Values: map[string]*dynamodb.AttributeValue{
+			":ddblock_fence": token,
+		},
+		Set:   "#ddblock_fence = :ddblock_fence",
+		attr:  attr,
+		token: token,
+	}, nil
+}
+
+// ApplyPut adds the condition to the put, along with any condition it
+// already has, and sets the fence attribute of its item to the token.
+func (c *FenceCondition) ApplyPut(params *dynamodb.PutItemInput) {
+	params.ConditionExpression = c.and(params.ConditionExpression)
+	params.ExpressionAttributeNames = c.names(params.ExpressionAttributeNames)
+	params.ExpressionAttributeValues = c.values(params.ExpressionAttributeValues)
+
+	if params.Item == nil {
+		params.Item = make(map[string]*dynamodb.AttributeValue)
+	}
+	params.Item[c.attr] = c.token
+}
+
+// ApplyUpdate adds the condition to the update, along with any condition
+// it already has, and sets the fence attribute to the token.
+func (c *FenceCondition) ApplyUpdate(params *dynamodb.UpdateItemInput) {
+	params.ConditionExpression = c.and(params.ConditionExpression)
+	params.ExpressionAttributeNames = c.names(params.ExpressionAttributeNames)
+	params.ExpressionAttributeValues = c.values(params.ExpressionAttributeValues)
+
+	update := aws.StringValue(params.UpdateExpression)
+	if loc := setClause.FindStringIndex(update); loc != nil {
+		update = update[:loc[1]] + c.Set + ", " + update[loc[1]:]
+	} else {
+		update = strings.TrimSpace("SET " + c.Set + " " + update)
+	}
+	params.UpdateExpression = aws.String(update)
+}
+
+// setClause matches the start of the SET clause of an update expression.
+var setClause = regexp.MustCompile(`(?i)\bSET\s+`)
+
+func (c *FenceCondition) and(cond *string) *string {
+	if aws.StringValue(cond) == "" {
+		return aws.String(c.Expression)
+	}
+
+	return aws.String("(" + *cond + ") AND (" + c.Expression + ")")
+}
+
+func (c *FenceCondition) names(names map[string]*string) map[string]*string {
+	if names == nil {
+		names = make(map[string]*string, len(c.Names))
+	}
+
+	for k, v := range c.Names {
+		names[k] = v
+	}
+
+	return names
+}
+
+func (c *FenceCondition) values(values map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if values == nil {
+		values = make(map[string]*dynamodb.AttributeValue, len(c.Values))
+	}
+
+	for k, v := range c.Values {
+		values[k] = v
+	}
+
+	return values
+}
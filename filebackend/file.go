@@ -0,0 +1,171 @@
+// Package filebackend stores ddblock locks as files in a local directory,
+// so lock dependent code can be exercised during development without any
+// cloud dependency:
+//
+//	b := filebackend.New(filepath.Join(os.TempDir(), "ddblock"))
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(b))
+//
+// Each lock is a JSON file of the lease. Changes are serialized across
+// processes on the same machine with flock on a sidecar file, on systems
+// without flock only within the process.
+package filebackend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// Backend is a ddblock.Backend storing locks in a directory.
+type Backend struct {
+	Dir string
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates a backend storing the locks in the directory,
+// which is created if needed.
+func New(dir string) *Backend {
+	return &Backend{
+		Dir: dir,
+	}
+}
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	var previous *ddblock.LockInfo
+	err := b.locked(lease.Name, func(path string) error {
+		current, err := read(path)
+		if err != nil {
+			return err
+		}
+
+		if current != nil && current.UUID != lease.UUID {
+			if !current.Expires.Before(cutoff) {
+				return ddblock.ErrConflict
+			}
+
+			previous = current
+		}
+
+		return write(path, lease)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	return b.locked(lease.Name, func(path string) error {
+		current, err := read(path)
+		if err != nil {
+			return err
+		}
+
+		if current == nil || current.UUID != lease.UUID {
+			return ddblock.ErrConflict
+		}
+
+		return write(path, lease)
+	})
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	return b.locked(name, func(path string) error {
+		current, err := read(path)
+		if err != nil {
+			return err
+		}
+
+		if current == nil || current.UUID != uuid {
+			return ddblock.ErrConflict
+		}
+
+		return os.Remove(path)
+	})
+}
+
+// Get returns the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	var lease *ddblock.LockInfo
+	err := b.locked(name, func(path string) error {
+		var err error
+		lease, err = read(path)
+		return err
+	})
+
+	return lease, err
+}
+
+// locked runs fn with the path of the lease file while holding
+// the file lock of the named lock.
+func (b *Backend) locked(name string, fn func(path string) error) error {
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(b.Dir, url.PathEscape(name)+".json")
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn(path)
+}
+
+func read(path string) (*ddblock.LockInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &ddblock.LockInfo{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// write replaces the file atomically, so a crash never leaves half a lease.
+func write(path string, lease *ddblock.LockInfo) error {
+	data, err := json.MarshalIndent(lease, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,15 @@
+package filebackend_test
+
+import (
+	"testing"
+
+	"github.com/paulmach/ddblock"
+	"github.com/paulmach/ddblock/conformance"
+	"github.com/paulmach/ddblock/filebackend"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() ddblock.Backend {
+		return filebackend.New(t.TempDir())
+	})
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package filebackend
+
+import "sync"
+
+var (
+	locksLk sync.Mutex
+	locks   = map[string]*sync.Mutex{}
+)
+
+// lockFile locks the path within this process only, flock is not available.
+func lockFile(path string) (func(), error) {
+	locksLk.Lock()
+	lk := locks[path]
+	if lk == nil {
+		lk = &sync.Mutex{}
+		locks[path] = lk
+	}
+	locksLk.Unlock()
+
+	lk.Lock()
+	return lk.Unlock, nil
+}
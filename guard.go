@@ -0,0 +1,109 @@
+package ddblock
+
+import (
+	"runtime/pprof"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// Verify checks with a consistent read that the lock item still belongs
+// to this mutex and the lease has not lapsed. This is stronger than trusting
+// the local renewal state. ErrNotHeld is returned if the lock is not held or
+// the lease has lapsed, ErrLockLost if someone else holds it.
+func (m *Mutex) Verify(ctx context.Context) error {
+	m.lk.Lock()
+	uuid, held := m.uuid, m.uuid != "" && m.remaining() > 0
+	m.lk.Unlock()
+
+	if !held {
+		return ErrNotHeld
+	}
+
+	if m.backend != nil {
+		lease, err := m.backend.Get(ctx, m.fullname)
+		if err != nil {
+			return err
+		}
+
+		if lease == nil {
+			return ErrNotHeld
+		}
+
+		if lease.UUID != uuid {
+			return ErrLockLost
+		}
+
+		return nil
+	}
+
+	resp, err := m.db().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &m.TableName,
+		Key:            m.Schema.key(m.fullname),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+
+	if len(resp.Item) == 0 {
+		return ErrNotHeld
+	}
+
+	if m.Schema.lockInfo(resp.Item).UUID != uuid {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// Guard runs fn while calling Verify every interval. If verification fails
+// fn's context is canceled immediately and the verification error is
+// returned once fn returns. Otherwise fn's error is returned. Errors reading
+// the item, such as throttling, are not treated as a failed verification.
+func (m *Mutex) Guard(ctx context.Context, interval time.Duration, fn func(context.Context) error) error {
+	if err := m.Verify(ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		pprof.SetGoroutineLabels(pprof.WithLabels(ctx, m.labels()))
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+
+			err := m.Verify(ctx)
+			if err == ErrNotHeld || err == ErrLockLost {
+				failed <- err
+				cancel()
+				return
+			}
+		}
+	}()
+
+	err := fn(ctx)
+
+	select {
+	case verr := <-failed:
+		return verr
+	default:
+		return err
+	}
+}
@@ -0,0 +1,67 @@
+package ddblock
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var heirString = "heir"
+
+// DefaultHeirWindow is how long a designated heir has to claim
+// a lock before anyone else may take it.
+var DefaultHeirWindow = 5 * time.Second
+
+// heirExpiredCondition is like expiredCondition but with the
+// cutoff times, :hexpns and :hexps, moved back by the heir window.
+const heirExpiredCondition = "((#exp >= :cutoff AND #exp < :hexpns) OR (#exp < :cutoff AND #exp < :hexps))"
+
+// Designate names the preferred successor, matching the Candidate of
+// another mutex, or clears it if empty. When this lock is released or
+// expires the heir has an exclusive HeirWindow to claim it before anyone
+// else can. The heir is written to the lock item immediately. The heir
+// is only for the current lease, ErrNotHeld is returned if the lock is
+// not held and the heir is not kept for the next lease.
+func (m *Mutex) Designate(heir string) error {
+	m.lk.Lock()
+	if m.uuid == "" || m.renewed.IsZero() {
+		m.lk.Unlock()
+		return ErrNotHeld
+	}
+
+	m.heir = heir
+	m.lk.Unlock()
+
+	return m.update()
+}
+
+// heirCondition returns the part of the acquire condition that, while the
+// previous holder's heir window is open, only lets the heir take over.
+// Its names and values are added to the params. Must be called with m.lk held.
+func (m *Mutex) heirCondition(params *dynamodb.PutItemInput, cutoff time.Time) string {
+	window := m.HeirWindow
+	if window <= 0 {
+		window = DefaultHeirWindow
+	}
+
+	cond := "attribute_not_exists(#heir) OR " + heirExpiredCondition
+	if m.Candidate != "" {
+		cond = "attribute_not_exists(#heir) OR #heir = :candidate OR " + heirExpiredCondition
+		params.ExpressionAttributeValues[":candidate"] = &dynamodb.AttributeValue{
+			S: aws.String(m.Candidate),
+		}
+	}
+
+	hcutoff := cutoff.Add(-window)
+	params.ExpressionAttributeNames["#heir"] = &heirString
+	params.ExpressionAttributeValues[":hexpns"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(hcutoff.UnixNano(), 10)),
+	}
+	params.ExpressionAttributeValues[":hexps"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(hcutoff.Unix(), 10)),
+	}
+
+	return cond
+}
@@ -0,0 +1,113 @@
+package ddblock
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// holdSamples is the number of recent hold durations kept
+// per lock name to compute percentiles.
+const holdSamples = 1024
+
+// holdNames is the number of lock names with statistics, the least
+// recently held name is dropped to make room for a new one.
+const holdNames = 1024
+
+// HoldStats summarizes how long a lock was held by this process.
+type HoldStats struct {
+	Count int           `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+
+	// P95 is over the most recent holds only.
+	P95 time.Duration `json:"p95"`
+}
+
+type holdRecord struct {
+	stats   HoldStats
+	samples []time.Duration
+	next    int
+	last    time.Time
+}
+
+var (
+	holds   = map[string]*holdRecord{}
+	holdsLk sync.Mutex
+)
+
+func init() {
+	expvar.Publish("ddblock_holds", expvar.Func(func() interface{} {
+		return HoldDurations()
+	}))
+}
+
+// HoldDurations returns the hold time statistics of the locks held by this
+// process since it started, by lock name, for the 1024 most recently held
+// names. It is also published with expvar as "ddblock_holds" to find
+// critical sections that have grown.
+func HoldDurations() map[string]HoldStats {
+	holdsLk.Lock()
+	defer holdsLk.Unlock()
+
+	result := make(map[string]HoldStats, len(holds))
+	for name, r := range holds {
+		stats := r.stats
+
+		sorted := append([]time.Duration(nil), r.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats.P95 = sorted[(len(sorted)*95-1)/100]
+
+		result[name] = stats
+	}
+
+	return result
+}
+
+// recordHold adds a hold of the lock to the statistics.
+func recordHold(name string, d time.Duration) {
+	holdsLk.Lock()
+	defer holdsLk.Unlock()
+
+	r := holds[name]
+	if r == nil {
+		if len(holds) >= holdNames {
+			evictHold()
+		}
+
+		r = &holdRecord{}
+		holds[name] = r
+	}
+
+	r.last = time.Now()
+
+	r.stats.Count++
+	r.stats.Total += d
+	if d > r.stats.Max {
+		r.stats.Max = d
+	}
+
+	if len(r.samples) < holdSamples {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+		r.next = (r.next + 1) % holdSamples
+	}
+}
+
+// evictHold drops the statistics of the least recently held lock.
+// Must be called with holdsLk held.
+func evictHold() {
+	var (
+		oldest string
+		last   time.Time
+	)
+	for name, r := range holds {
+		if oldest == "" || r.last.Before(last) {
+			oldest, last = name, r.last
+		}
+	}
+
+	delete(holds, oldest)
+}
@@ -0,0 +1,227 @@
+package ddblock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// identityTimeout bounds the metadata requests when detecting the runtime
+// identity, which will time out when not running on that infrastructure.
+const identityTimeout = time.Second
+
+var ownerString = "owner"
+
+// Owner identifies who holds a lock in terms of the process and the
+// infrastructure it is running on. Fields that could not be determined,
+// or were not recorded, are empty.
+type Owner struct {
+	// Name is the caller supplied owner, see Mutex.OwnerName.
+	Name string
+
+	// Hostname, PID and Started identify the process, Started being
+	// approximately when it started.
+	Hostname string
+	PID      int
+	Started  time.Time
+
+	// InstanceID is the EC2 instance id, from the instance metadata service.
+	InstanceID string
+
+	// TaskARN is the ECS task arn, from the task metadata endpoint.
+	TaskARN string
+
+	// Pod and Namespace are the Kubernetes pod name and namespace,
+	// from the POD_NAME and POD_NAMESPACE environment variables, as usually
+	// set using the downward API, or the hostname and service account.
+	Pod       string
+	Namespace string
+}
+
+// processStarted approximates when this process started.
+var processStarted = time.Now()
+
+var (
+	hostname     string
+	hostnameOnce sync.Once
+)
+
+// identity returns the owner recorded on the lock item, the process and,
+// with RecordOwner, its runtime identity.
+func (m *Mutex) identity() *Owner {
+	o := &Owner{}
+	if m.RecordOwner {
+		*o = *detectOwner()
+	}
+
+	hostnameOnce.Do(func() {
+		hostname, _ = os.Hostname()
+	})
+
+	o.Name = m.OwnerName
+	o.Hostname = hostname
+	o.PID = os.Getpid()
+	o.Started = processStarted
+
+	return o
+}
+
+var (
+	runtimeOwner     *Owner
+	runtimeOwnerOnce sync.Once
+)
+
+// detectOwner returns the runtime identity of this process. It is
+// determined once and shared by all mutexes, so it is not bound to the
+// context of the first mutex to ask for it.
+func detectOwner() *Owner {
+	runtimeOwnerOnce.Do(func() {
+		o := &Owner{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), identityTimeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			o.InstanceID = ec2InstanceID(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			o.TaskARN = ecsTaskARN(ctx)
+		}()
+		o.Pod, o.Namespace = kubernetesPod()
+		wg.Wait()
+
+		runtimeOwner = o
+	})
+
+	return runtimeOwner
+}
+
+func ec2InstanceID(ctx context.Context) string {
+	svcLk.Lock()
+	client := ec2metadata.New(getSession(), aws.NewConfig().WithMaxRetries(0))
+	svcLk.Unlock()
+
+	id, err := client.GetMetadataWithContext(ctx, "instance-id")
+	if err != nil {
+		return ""
+	}
+
+	return id
+}
+
+func ecsTaskARN(ctx context.Context) string {
+	uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if uri == "" {
+		return ""
+	}
+
+	req, err := http.NewRequest("GET", uri+"/task", nil)
+	if err != nil {
+		return ""
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	var task struct {
+		TaskARN string
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&task) != nil {
+		return ""
+	}
+
+	return task.TaskARN
+}
+
+func kubernetesPod() (string, string) {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return "", ""
+	}
+
+	pod := os.Getenv("POD_NAME")
+	if pod == "" {
+		pod, _ = os.Hostname()
+	}
+
+	ns := os.Getenv("POD_NAMESPACE")
+	if ns == "" {
+		data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err == nil {
+			ns = strings.TrimSpace(string(data))
+		}
+	}
+
+	return pod, ns
+}
+
+// attribute encodes the owner as a map attribute, omitting empty fields.
+func (o *Owner) attribute() *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue)
+	add := func(k, v string) {
+		if v != "" {
+			m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+		}
+	}
+
+	add("name", o.Name)
+	add("hostname", o.Hostname)
+	if o.PID != 0 {
+		m["pid"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(o.PID))}
+	}
+	if !o.Started.IsZero() {
+		m["started"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(o.Started.UnixNano(), 10))}
+	}
+	add("instance_id", o.InstanceID)
+	add("task_arn", o.TaskARN)
+	add("pod", o.Pod)
+	add("namespace", o.Namespace)
+
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func ownerFromAttribute(av *dynamodb.AttributeValue) *Owner {
+	get := func(k string) string {
+		if v := av.M[k]; v != nil {
+			return aws.StringValue(v.S)
+		}
+		return ""
+	}
+
+	o := &Owner{
+		Name:       get("name"),
+		Hostname:   get("hostname"),
+		InstanceID: get("instance_id"),
+		TaskARN:    get("task_arn"),
+		Pod:        get("pod"),
+		Namespace:  get("namespace"),
+	}
+
+	if v := av.M["pid"]; v != nil {
+		o.PID, _ = strconv.Atoi(aws.StringValue(v.N))
+	}
+	if v := av.M["started"]; v != nil {
+		if ns, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64); err == nil {
+			o.Started = time.Unix(0, ns)
+		}
+	}
+
+	return o
+}
@@ -0,0 +1,358 @@
+package ddblock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+
+	"golang.org/x/net/context"
+)
+
+// Inspector reads lock items without ever writing them, for dashboards
+// and support tools. It only needs the dynamodb:GetItem and dynamodb:Scan
+// permissions and, for Watch, to read the table's stream.
+type Inspector struct {
+	TableName string
+	Prefix    string
+
+	// Schema names the attributes of the lock items, DefaultSchema if nil.
+	Schema *Schema
+
+	svc     dynamodbiface.DynamoDBAPI
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI
+}
+
+// NewInspector creates an inspector for the locks in the table,
+// DefaultTableName if empty, using the DefaultPrefix.
+func NewInspector(tableName string) *Inspector {
+	if tableName == "" {
+		tableName = DefaultTableName
+	}
+
+	return &Inspector{
+		TableName: tableName,
+		Prefix:    DefaultPrefix,
+	}
+}
+
+// GetLockInfo returns the lock item for the named lock, or nil if there is
+// none. The item may have expired, check its Expires, or be the tombstone
+// of a recent release, check its ReleasedAt.
+func (i *Inspector) GetLockInfo(ctx context.Context, name string) (*LockInfo, error) {
+	resp, err := i.db().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &i.TableName,
+		Key:            i.Schema.key(i.Prefix + name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+
+	return i.Schema.lockInfo(resp.Item), nil
+}
+
+// ErrInvalidPageToken is returned by ListLocksPage for a malformed page token.
+var ErrInvalidPageToken = errors.New("ddbmutex: invalid page token")
+
+// helperItem matches the names of the shard, advisory and sequencer
+// items that are stored along side the lock items.
+var helperItem = regexp.MustCompile(`#(shard-[0-9]+|advisory|ticket|serving|semaphore)$`)
+
+// ListLocks returns all the lock items in the table with the prefix,
+// including expired ones that have not been removed yet. It scans the
+// whole table so should not be called often on large tables.
+func (i *Inspector) ListLocks(ctx context.Context) ([]*LockInfo, error) {
+	var locks []*LockInfo
+	err := i.db().ScanPagesWithContext(ctx, i.scanInput(""), func(page *dynamodb.ScanOutput, last bool) bool {
+		locks = append(locks, i.Schema.lockInfos(page.Items)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+// ListExpiredLocks returns the lock items in the table with the prefix that
+// expired before the time, for cleanup and monitoring. This includes the
+// tombstones of released locks. With the Schema's ExpiryIndex the index is
+// queried, otherwise the whole table is scanned.
+func (i *Inspector) ListExpiredLocks(ctx context.Context, before time.Time) ([]*LockInfo, error) {
+	index := i.Schema.expiryIndex()
+	if index == "" {
+		locks, err := i.ListLocks(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var expired []*LockInfo
+		for _, l := range locks {
+			if l.Expires.Before(before) {
+				expired = append(expired, l)
+			}
+		}
+
+		return expired, nil
+	}
+
+	// expires is in nanoseconds or, for ExpiresSeconds, seconds
+	// which are all before the expiresCutoff.
+	ranges := [][2]int64{
+		{expiresCutoff, before.UnixNano() - 1},
+		{0, before.Unix() - 1},
+	}
+
+	var locks []*LockInfo
+	for _, r := range ranges {
+		params := &dynamodb.QueryInput{
+			TableName:              &i.TableName,
+			IndexName:              &index,
+			KeyConditionExpression: aws.String("#part = :part AND #exp BETWEEN :from AND :to"),
+			ExpressionAttributeNames: map[string]*string{
+				"#part": &expiryPartitionString,
+				"#exp":  aws.String(i.Schema.expiresName()),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":part": {
+					S: aws.String(expiryPartition),
+				},
+				":from": {
+					N: aws.String(strconv.FormatInt(r[0], 10)),
+				},
+				":to": {
+					N: aws.String(strconv.FormatInt(r[1], 10)),
+				},
+			},
+		}
+
+		if i.Prefix != "" {
+			params.FilterExpression = aws.String("begins_with(#name, :prefix)")
+			params.ExpressionAttributeNames["#name"] = aws.String(i.Schema.keyName())
+			params.ExpressionAttributeValues[":prefix"] = &dynamodb.AttributeValue{S: &i.Prefix}
+		}
+
+		err := i.db().QueryPagesWithContext(ctx, params, func(page *dynamodb.QueryOutput, last bool) bool {
+			locks = append(locks, i.Schema.lockInfos(page.Items)...)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locks, nil
+}
+
+// ListOptions selects the locks returned by ListLocksPage.
+type ListOptions struct {
+	// Prefix restricts the locks to names starting with it,
+	// after the inspector's Prefix.
+	Prefix string
+
+	// Limit is the most locks in the page, 100 if zero.
+	Limit int
+
+	// PageToken continues from the end of a previous page, its NextPageToken.
+	PageToken string
+}
+
+// LockPage is a page of locks from ListLocksPage.
+type LockPage struct {
+	Locks []*LockInfo
+
+	// NextPageToken is empty if this is the last page.
+	NextPageToken string
+}
+
+// ListLocksPage returns a page of the lock items in the table, including
+// expired ones, for operators taking an inventory of outstanding locks.
+// Like ListLocks it scans the table, the pages are not in name order.
+func (i *Inspector) ListLocksPage(ctx context.Context, opts ListOptions) (*LockPage, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	params := i.scanInput(opts.Prefix)
+	if opts.PageToken != "" {
+		key, err := decodePageToken(opts.PageToken)
+		if err != nil {
+			return nil, err
+		}
+
+		params.ExclusiveStartKey = key
+	}
+
+	page := &LockPage{}
+	for {
+		// never evaluate more items than can be returned,
+		// so the page ends exactly at the last evaluated key
+		params.Limit = aws.Int64(int64(limit - len(page.Locks)))
+
+		resp, err := i.db().ScanWithContext(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Locks = append(page.Locks, i.Schema.lockInfos(resp.Items)...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return page, nil
+		}
+
+		if len(page.Locks) >= limit {
+			page.NextPageToken, err = encodePageToken(resp.LastEvaluatedKey)
+			return page, err
+		}
+
+		params.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// scanInput returns the scan of the items of the inspector's locks,
+// with names starting with the prefix.
+func (i *Inspector) scanInput(prefix string) *dynamodb.ScanInput {
+	params := &dynamodb.ScanInput{
+		TableName: &i.TableName,
+	}
+
+	var filters []string
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+	if prefix = i.Prefix + prefix; prefix != "" {
+		filters = append(filters, "begins_with(#name, :prefix)")
+		names["#name"] = aws.String(i.Schema.keyName())
+		values[":prefix"] = &dynamodb.AttributeValue{S: &prefix}
+	}
+
+	if sk := i.Schema.sortKeyName(); sk != "" {
+		// only the lock items of a single table design
+		filters = append(filters, "#sk = :sk")
+		names["#sk"] = aws.String(sk)
+		values[":sk"] = &dynamodb.AttributeValue{S: aws.String(i.Schema.SortValue)}
+	}
+
+	if len(filters) > 0 {
+		params.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		params.ExpressionAttributeNames = names
+		params.ExpressionAttributeValues = values
+	}
+
+	return params
+}
+
+// lockInfos returns the lock items, skipping the helper items.
+func (s *Schema) lockInfos(items []map[string]*dynamodb.AttributeValue) []*LockInfo {
+	var locks []*LockInfo
+	for _, item := range items {
+		info := s.lockInfo(item)
+		if !helperItem.MatchString(info.Name) {
+			locks = append(locks, info)
+		}
+	}
+
+	return locks
+}
+
+// encodePageToken encodes the string attributes of the key, the only
+// kind used by the lock table keys, as an opaque token.
+func encodePageToken(key map[string]*dynamodb.AttributeValue) (string, error) {
+	values := make(map[string]string, len(key))
+	for k, v := range key {
+		values[k] = aws.StringValue(v.S)
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	key := make(map[string]*dynamodb.AttributeValue, len(values))
+	for k, v := range values {
+		key[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+
+	return key, nil
+}
+
+// Watch returns the changes to the named lock, or all locks with the prefix
+// if name is empty, as seen on the table's stream. The stream must be
+// enabled, preferably with new and old images so events include the item.
+// The channel is closed when the context is done. Events are dropped if the
+// receiver falls too far behind.
+func (i *Inspector) Watch(ctx context.Context, name string) <-chan LockEvent {
+	fullname := ""
+	if name != "" {
+		fullname = i.Prefix + name
+	}
+
+	events, stop := subscribe(i.db(), i.streamsDB(), i.TableName, fullname, i.Schema, false)
+
+	out := make(chan LockEvent)
+	go func() {
+		defer close(out)
+		defer stop()
+
+		for {
+			select {
+			case e := <-events:
+				if fullname == "" && (!strings.HasPrefix(e.Name, i.Prefix) || helperItem.MatchString(e.Name)) {
+					continue
+				}
+
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func (i *Inspector) db() dynamodbiface.DynamoDBAPI {
+	if i.svc != nil {
+		return i.svc
+	}
+
+	return getSvc()
+}
+
+func (i *Inspector) streamsDB() dynamodbstreamsiface.DynamoDBStreamsAPI {
+	if i.streams != nil {
+		return i.streams
+	}
+
+	return getStreamSvc()
+}
@@ -0,0 +1,86 @@
+package ddblock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestInspectorListLocksPage(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+
+	expires := nanos(time.Now().Add(time.Minute))
+	for _, name := range []string{"a", "b1", "b1#serving", "b1#ticket", "b2", "c", "c#semaphore", "d"} {
+		db.put(lockItem(DefaultPrefix+name, "uuid", expires))
+	}
+	db.put(lockItem("other-e", "uuid", expires))
+
+	cases := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{name: "one per page", limit: 1, want: []string{"a", "b1", "b2", "c", "d"}},
+		{name: "two per page", limit: 2, want: []string{"a", "b1", "b2", "c", "d"}},
+		{name: "exact pages", limit: 5, want: []string{"a", "b1", "b2", "c", "d"}},
+		{name: "default limit", want: []string{"a", "b1", "b2", "c", "d"}},
+		{name: "prefix", prefix: "b", limit: 1, want: []string{"b1", "b2"}},
+		{name: "no match", prefix: "z", limit: 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := NewInspector("")
+			i.svc = db
+
+			var names []string
+			opts := ListOptions{Prefix: tc.prefix, Limit: tc.limit}
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatalf("too many pages")
+				}
+
+				page, err := i.ListLocksPage(ctx, opts)
+				if err != nil {
+					t.Fatalf("list: %v", err)
+				}
+
+				if tc.limit > 0 && len(page.Locks) > tc.limit {
+					t.Errorf("page: expected at most %d locks, got %d", tc.limit, len(page.Locks))
+				}
+
+				for _, l := range page.Locks {
+					names = append(names, l.Name[len(DefaultPrefix):])
+				}
+
+				if page.NextPageToken == "" {
+					break
+				}
+				opts.PageToken = page.NextPageToken
+			}
+
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, names)
+			}
+		})
+	}
+
+	i := NewInspector("")
+	i.svc = db
+	if _, err := i.ListLocksPage(ctx, ListOptions{PageToken: "not a token"}); err != ErrInvalidPageToken {
+		t.Errorf("invalid token: expected %v, got %v", ErrInvalidPageToken, err)
+	}
+
+	locks, err := i.ListLocks(ctx)
+	if err != nil {
+		t.Fatalf("list all: %v", err)
+	}
+
+	if len(locks) != 5 {
+		t.Errorf("list all: expected 5 locks, got %d", len(locks))
+	}
+}
@@ -0,0 +1,111 @@
+package ddblock
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultJanitorGrace is how long after expiring a lock item is
+// deleted by a janitor.
+var DefaultJanitorGrace = time.Hour
+
+// Janitor deletes the lock items of a client that expired long ago, so
+// abandoned locks do not accumulate in tables without DynamoDB TTL enabled.
+// An item is only deleted if it is still expired when it is deleted, a lock
+// taken or renewed meanwhile is left alone.
+type Janitor struct {
+	Client *Client
+
+	// Grace is how long after expiring an item is deleted,
+	// DefaultJanitorGrace if zero.
+	Grace time.Duration
+
+	// OnError, if set, is called when a sweep fails. Run keeps going.
+	OnError func(err error)
+}
+
+// Run sweeps every interval until the context is done,
+// it returns the context's error.
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := j.Sweep(ctx); err != nil && ctx.Err() == nil && j.OnError != nil {
+			j.OnError(err)
+		}
+
+		sleep(ctx, interval)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Sweep deletes the lock items that expired more than the grace period
+// ago and returns how many were deleted.
+func (j *Janitor) Sweep(ctx context.Context) (int, error) {
+	grace := j.Grace
+	if grace <= 0 {
+		grace = DefaultJanitorGrace
+	}
+
+	cutoff := time.Now().Add(-grace)
+	locks, err := j.Client.NewInspector().ListExpiredLocks(ctx, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, l := range locks {
+		err := j.delete(ctx, l.Name, cutoff)
+		if IsAquireError(err) {
+			// taken or renewed since
+			continue
+		}
+
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// delete removes the named item if it expired before the cutoff.
+func (j *Janitor) delete(ctx context.Context, name string, cutoff time.Time) error {
+	c := j.Client
+	_, err := c.db().DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           &c.TableName,
+		Key:                 c.Schema.key(name),
+		ConditionExpression: aws.String(expiredCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#exp": aws.String(c.Schema.expiresName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cutoff": {
+				N: aws.String(strconv.FormatInt(expiresCutoff, 10)),
+			},
+			":expns": {
+				N: aws.String(strconv.FormatInt(cutoff.UnixNano(), 10)),
+			},
+			":exps": {
+				N: aws.String(strconv.FormatInt(cutoff.Unix(), 10)),
+			},
+		},
+	})
+
+	return err
+}
+
+// RunJanitor deletes the client's lock items that expired more than the
+// DefaultJanitorGrace ago, every interval, until the context is done.
+// See Janitor to configure the grace period.
+func (c *Client) RunJanitor(ctx context.Context, interval time.Duration) error {
+	j := &Janitor{Client: c}
+	return j.Run(ctx, interval)
+}
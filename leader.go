@@ -0,0 +1,89 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RunWhenLeader campaigns for leadership, holding the lock of m, and runs fn
+// only while leader. The context given to fn is canceled as soon as
+// leadership is lost, after which fn's return is waited for and the
+// campaign starts again, so fn is restarted on re-election.
+//
+// Canceling ctx resigns: fn's context is canceled, fn is waited for and the
+// lock is released before returning ctx.Err(). If fn returns on its own the
+// lock is released and its error is returned.
+//
+// The runner renews the lease itself so m is switched to ManualRenew.
+func RunWhenLeader(ctx context.Context, m *Mutex, fn func(context.Context) error) error {
+	m.lk.Lock()
+	m.ManualRenew = true
+	m.lk.Unlock()
+
+	for {
+		if _, err := m.LockWait(ctx); err != nil {
+			return err
+		}
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- fn(leaderCtx)
+		}()
+
+		finished, err := m.lead(ctx, done)
+		cancel()
+
+		if !finished {
+			// fn's return is moot once leadership is lost or resigned
+			<-done
+		}
+
+		if ctx.Err() != nil || finished {
+			// resign, or fn is done with leadership
+			m.Unlock()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		// leadership was lost, campaign again
+	}
+}
+
+// lead renews the lease while fn runs. It returns true and fn's error if fn
+// returned, or false if leadership was lost, with the reason, or ctx was
+// canceled first, with a nil error.
+func (m *Mutex) lead(ctx context.Context, done <-chan error) (bool, error) {
+	wait := m.nextRenewal()
+	for {
+		select {
+		case err := <-done:
+			return true, err
+		case <-ctx.Done():
+			return false, nil
+		case <-time.After(wait):
+		}
+
+		err := m.Renew()
+		if err == nil {
+			wait = m.nextRenewal()
+			continue
+		}
+
+		if err == ErrLockLost || err == ErrNotHeld || err == ErrMaxHoldTime {
+			// already signaled
+			return false, err
+		}
+
+		var ok bool
+		wait, ok = m.renewalRetry(err)
+		if !ok {
+			m.lapsed(err)
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Lease is a lock without a background heartbeat. The holder renews it
+// explicitly, for example between the steps of a batch job or in a Lambda
+// function that may be frozen between invocations.
+type Lease struct {
+	m *Mutex
+}
+
+// NewLease creates a lease on the named lock. The options are those of New,
+// WithTTL sets the duration of the first lease.
+func NewLease(ctx context.Context, name string, opts ...Option) *Lease {
+	m := New(ctx, name, opts...)
+	m.ManualRenew = true
+
+	return &Lease{m: m}
+}
+
+// Acquire takes the lock, waiting until it is free or the context is done.
+func (l *Lease) Acquire(ctx context.Context) error {
+	_, err := l.m.LockWait(ctx)
+	return err
+}
+
+// Renew extends the lease to ttl from now, zero keeps the current ttl.
+// ErrNotHeld is returned if the lease is not held and ErrLockLost if
+// someone else took the lock after it lapsed.
+func (l *Lease) Renew(ttl time.Duration) error {
+	if ttl > 0 {
+		l.m.lk.Lock()
+		l.m.TTL = ttl
+		l.m.lk.Unlock()
+	}
+
+	return l.m.update()
+}
+
+// Release deletes the lock item. See Mutex.Release.
+func (l *Lease) Release() (Ownership, error) {
+	return l.m.Release()
+}
+
+// Expiry returns when the lease lapses, measured from the last successful
+// acquisition or renewal with the local clock. It is the zero time if the
+// lease is not held.
+func (l *Lease) Expiry() time.Time {
+	l.m.lk.Lock()
+	defer l.m.lk.Unlock()
+
+	if l.m.uuid == "" || l.m.renewed.IsZero() {
+		return time.Time{}
+	}
+
+	return l.m.renewed.Add(l.m.ttl)
+}
+
+// Mutex returns the underlying mutex, for example to use Verify or Done.
+func (l *Lease) Mutex() *Mutex {
+	return l.m
+}
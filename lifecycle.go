@@ -0,0 +1,72 @@
+package ddblock
+
+// Lifecycle callbacks let the application react to the lease, for example
+// stopping consumers when it is lost, without polling. They are called in
+// order from a goroutine of the mutex, never while it is locked, so they
+// may call its methods, but a slow callback delays the following ones.
+type Lifecycle struct {
+	// OnAcquired is called when the lock is taken.
+	OnAcquired func()
+
+	// OnRenewed is called when the lease is extended.
+	OnRenewed func()
+
+	// OnRenewFailed is called when extending the lease fails. The lease
+	// is kept until it is found taken or lapses.
+	OnRenewFailed func(err error)
+
+	// OnLost is called when the lease is lost, with the reason, see Err.
+	OnLost func(err error)
+
+	// OnReleased is called when the lease ends other than by being lost,
+	// after Unlock, Release, Resign or Abandon.
+	OnReleased func()
+}
+
+// WithLifecycle sets the lifecycle callbacks of the mutex.
+func WithLifecycle(l Lifecycle) Option {
+	return func(m *Mutex) {
+		m.Lifecycle = l
+	}
+}
+
+// notify queues the callback to be called by the dispatching goroutine,
+// starting it if needed. Must be called with m.lk held.
+func (m *Mutex) notify(fn func()) {
+	m.callbacks = append(m.callbacks, fn)
+	if !m.dispatching {
+		m.dispatching = true
+		go m.dispatch()
+	}
+}
+
+func (m *Mutex) dispatch() {
+	for {
+		m.lk.Lock()
+		if len(m.callbacks) == 0 {
+			m.dispatching = false
+			m.lk.Unlock()
+			return
+		}
+
+		fn := m.callbacks[0]
+		m.callbacks = m.callbacks[1:]
+		m.lk.Unlock()
+
+		fn()
+	}
+}
+
+// lifecycle queues the callback for the result of the operation.
+// Must be called with m.lk held.
+func (m *Mutex) lifecycle(op Op, err error) {
+	l := m.Lifecycle
+	switch {
+	case op == OpAcquire && err == nil && l.OnAcquired != nil:
+		m.notify(l.OnAcquired)
+	case op == OpRenew && err == nil && l.OnRenewed != nil:
+		m.notify(l.OnRenewed)
+	case op == OpRenew && err != nil && !IsAquireError(err) && err != ErrLockLost && l.OnRenewFailed != nil:
+		m.notify(func() { l.OnRenewFailed(err) })
+	}
+}
@@ -0,0 +1,95 @@
+package ddblock
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrHoldLimit is returned by TryLock when acquiring the lock
+// would exceed the HoldLimit of the mutex.
+var ErrHoldLimit = errors.New("ddbmutex: hold limit reached")
+
+// HoldLimit caps how many locks may be held at the same time by the
+// mutexes sharing it, for example all the mutexes of one worker, so one
+// greedy worker can not take every partition of an assignment scheme.
+type HoldLimit struct {
+	slots chan struct{}
+}
+
+// NewHoldLimit creates a limit of max locks held at once. A max of zero,
+// or less, is no limit, as if the mutexes had no HoldLimit.
+func NewHoldLimit(max int) *HoldLimit {
+	if max < 1 {
+		return &HoldLimit{}
+	}
+
+	return &HoldLimit{
+		slots: make(chan struct{}, max),
+	}
+}
+
+// Held returns the number of locks currently held under the limit,
+// always zero if there is no limit.
+func (l *HoldLimit) Held() int {
+	return len(l.slots)
+}
+
+// unlimited is true if the limit is no limit, or nil.
+func (l *HoldLimit) unlimited() bool {
+	return l == nil || l.slots == nil
+}
+
+func (l *HoldLimit) take() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *HoldLimit) release() {
+	<-l.slots
+}
+
+// wait blocks until a slot is free or the context is done.
+// The slot is not taken.
+func (l *HoldLimit) wait(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		<-l.slots
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// takeSlot takes a slot of the hold limit, if any, for a new lease.
+// It returns true if a slot was taken by this call.
+func (m *Mutex) takeSlot() (bool, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.Limit.unlimited() || m.slot {
+		return false, nil
+	}
+
+	if !m.Limit.take() {
+		return false, ErrHoldLimit
+	}
+
+	m.limit, m.slot = m.Limit, true
+	return true, nil
+}
+
+// releaseSlot frees the slot of the hold limit, if one is taken.
+// Must be called with m.lk held.
+func (m *Mutex) releaseSlot() {
+	if !m.slot {
+		return
+	}
+
+	m.limit.release()
+	m.limit, m.slot = nil, false
+}
@@ -3,34 +3,94 @@
 package ddblock
 
 import (
+	crand "crypto/rand"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime/pprof"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
 
 	"golang.org/x/net/context"
 )
 
 var (
-	// ErrConflict is returned when trying to get a lock, but
-	// someone else already has it. The caller should wait and try again.
+	// ErrConflict is matched, with errors.Is, by the error returned when
+	// trying to get a lock, but someone else already has it. The caller
+	// should wait and try again.
 	ErrConflict = errors.New("ddbmutex: conflict, lock held by another")
+
+	// ErrLockLost is returned by Unlock when someone else took the lock
+	// after our lease lapsed. The critical section may have overlapped
+	// with the new holder's.
+	ErrLockLost = errors.New("ddbmutex: lock lost, taken by another after lease lapsed")
+
+	// ErrNotHeld is returned when renewing a lock that is not held,
+	// because it was never locked or has been unlocked.
+	ErrNotHeld = errors.New("ddbmutex: lock not held")
+
+	// ErrMaxHoldTime is the reason a lease was lost
+	// after being held for the mutex's MaxHoldTime.
+	ErrMaxHoldTime = errors.New("ddbmutex: lock held for the maximum hold time")
+
+	// ErrOneShot is returned when renewing a OneShot lock.
+	ErrOneShot = errors.New("ddbmutex: one shot lock can not be renewed")
+
+	// ErrTableMissing is matched, with errors.Is, by the errors of requests
+	// to a lock table that does not exist. See EnsureTable.
+	ErrTableMissing = errors.New("ddbmutex: lock table does not exist")
 )
 
-// default values set when creating a the Mutex.
+// ExpiryFormat is the encoding of the expires attribute written to dynamodb.
+type ExpiryFormat int
+
+const (
+	// ExpiresNanos stores the expiry as unix nanoseconds, the original format.
+	ExpiresNanos ExpiryFormat = iota
+
+	// ExpiresSeconds stores the expiry as unix seconds.
+	ExpiresSeconds
+)
+
+// expiresCutoff separates the two expiry formats when comparing. Unix seconds
+// will be below it for the next 30,000 years and unix nanoseconds have been
+// above it since 1970-01-01T00:16:40Z.
+const expiresCutoff = 1000000000000
+
+// default values set when creating a the Mutex. An empty DefaultRegion
+// resolves the region like other AWS tools, from AWS_REGION or
+// AWS_DEFAULT_REGION, the shared config file and then the EC2 instance
+// metadata. DefaultEndpoint, if set, points the default clients somewhere
+// else than AWS, such as DynamoDB Local at http://localhost:8000. They can be
+// overridden by the DDBLOCK_TABLE, DDBLOCK_TTL, DDBLOCK_PREFIX, DDBLOCK_REGION
+// and DDBLOCK_ENDPOINT environment variables, see loadEnv. DefaultPrefix is
+// used when a mutex is created, WithPrefix or Client.Prefix set another,
+// possibly empty, prefix.
 var (
 	DefaultTableName = "locks"
 	DefaultTTL       = time.Minute
+	DefaultPrefix    = "ddblock-"
+	DefaultRegion    = ""
+	DefaultEndpoint  = ""
 
-	nameString    = "name"
-	uuidString    = "uuid"
-	expiresString = "expires"
+	// DefaultExpiryFormat is the format used to write the expires attribute.
+	// Acquiring a lock understands both formats so it can be changed without
+	// stopping the fleet, as long as every instance is running a version that
+	// can read both.
+	DefaultExpiryFormat = ExpiresNanos
+
+	// DefaultGrace is the post expiry window during which an expired lock
+	// can not be taken over by another.
+	DefaultGrace time.Duration
 )
 
 // Mutex creates a lock using aws dynamodb. It uses
@@ -39,35 +99,324 @@ var (
 type Mutex struct {
 	lk sync.Mutex
 
-	ctx    context.Context
-	cancel func()
+	// ctx is the context given to New. cancel stops the heartbeat of
+	// the current lease, so the mutex can be locked again after Unlock.
+	ctx     context.Context
+	cancel  func()
+	svc     dynamodbiface.DynamoDBAPI
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	TableName    string
+	TTL          time.Duration
+	ExpiryFormat ExpiryFormat
+	Mode         Mode
+
+	// Schema names the attributes of the lock item, DefaultSchema if nil.
+	Schema *Schema
+
+	// EnforcePercent is the percentage, 0 to 100, of lock names that are
+	// enforced with the Rollout mode, the others run in Shadow mode. Names are
+	// chosen deterministically by hash so every instance in a fleet agrees.
+	// With RolloutByAcquisition each acquisition is chosen at random instead.
+	EnforcePercent       float64
+	RolloutByAcquisition bool
+
+	// OnExpiring, if set, is called when the lease is within ExpiringMargin
+	// of lapsing because renewals have not succeeded. It gives the application
+	// a chance to checkpoint and wind down before the lock is lost. It is
+	// called at most once per successful renewal, in its own goroutine.
+	OnExpiring func()
+
+	// HeartbeatInterval is how often the lease is renewed in the background.
+	// It must be shorter than the TTL and defaults to TTL/2.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatJitter is the fraction of the interval, from 0 to 1, by which
+	// each renewal is randomly made earlier, so processes that acquired locks
+	// at the same time, for example after a deploy, do not renew in waves.
+	// Defaults to DefaultHeartbeatJitter, negative disables it.
+	HeartbeatJitter float64
+
+	// ExpiringMargin is how long before the lease lapses OnExpiring is called.
+	// Defaults to TTL/4, shortly after a renewal, scheduled at TTL/2, is missed.
+	ExpiringMargin time.Duration
+
+	// Grace is how long after another holder's lease has expired before TryLock
+	// will take over. It absorbs modest clock skew and brief network partitions
+	// of the holder before ownership actually changes.
+	Grace time.Duration
+
+	// RetryInterval is the base delay between attempts of LockWait.
+	// It doubles with each recent conflict up to MaxRetryInterval,
+	// which defaults to the TTL.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// DrainWindow is how long a graceful Resign keeps renewing the lock
+	// after marking it as stepping down. Defaults to DefaultDrainWindow.
+	DrainWindow time.Duration
+
+	// Candidate identifies this mutex when it is designated as the heir
+	// of the current holder with Designate. Empty means it can not be heir.
+	Candidate string
+
+	// HeirWindow is how long a designated heir has to claim the lock
+	// after it is released or expires before this mutex will take it.
+	// It should be the same for all contenders. Defaults to DefaultHeirWindow.
+	HeirWindow time.Duration
+
+	// Limit, if set, caps the number of locks held at once by all the
+	// mutexes sharing it. TryLock fails with ErrHoldLimit beyond it while
+	// LockWait waits for one of the other locks to be released.
+	Limit *HoldLimit
+
+	// ReleaseRetries is how many times a release that failed, for example
+	// because of a network error during shutdown, is retried in the
+	// background instead of Unlock returning the error and leaving the
+	// lock held for a full TTL. Zero means DefaultReleaseRetries and a
+	// negative value disables the retries. See WaitReleases.
+	ReleaseRetries int
 
-	TableName string
-	TTL       time.Duration
+	// Tombstones, if set, replaces the lock item on release with a tombstone
+	// recording when it was released and how long it was held, instead of
+	// deleting it. Tools can then tell a recently released lock from one that
+	// was never locked. The tombstone expires right away so it is removed by
+	// DynamoDB TTL, if enabled, and can be acquired immediately.
+	Tombstones bool
+
+	// Fencing gives every lease a fencing token, see Fence, greater than the
+	// token of the previous lease, which is read before every acquisition,
+	// including those of AcquireAll. Renewals, also those of a Session, keep
+	// the token. Only enforced locks stored in DynamoDB have fencing tokens,
+	// Fence is zero for the others.
+	Fencing bool
+
+	// Reason is a human readable explanation of why the lock is held,
+	// stored on the item. It may be required by the Policy.
+	Reason string
+
+	// Metadata are caller defined attributes stored on the item, for example
+	// the job parameters or work assigned to the holder. They are read back
+	// with Inspector.GetLockInfo. Changes are written on the next acquisition
+	// or renewal, they must not be made while a lock attempt is in progress.
+	Metadata map[string]string
+
+	// Policy are the guardrails of the client, DefaultClientPolicy if nil.
+	Policy *ClientPolicy
+
+	// Auditors receive the lifecycle events of the lock.
+	Auditors []Auditor
+
+	// InitialJitter, if set, delays the first acquisition attempt of the mutex
+	// by a random duration up to it. When a deployment restarts many instances
+	// at once this spreads their attempts on the same locks.
+	InitialJitter time.Duration
+
+	// ManualRenew disables the background renewal goroutine. The lease then
+	// lasts one TTL unless the caller calls Renew. Use this where goroutines
+	// do not survive between invocations, such as AWS Lambda which freezes the
+	// process between requests. Canceling the context does not release the lock.
+	ManualRenew bool
+
+	// OneShot holds the lock for exactly one TTL, for short critical sections.
+	// There is no renewal goroutine, Renew and Extend return ErrOneShot, and
+	// the context does not need to be canceled. Unlock early to free the lock.
+	OneShot bool
+
+	// Shards, if set, spreads the load of many waiters for an extremely hot
+	// lock over this many extra items. The holder copies its expiry to every
+	// shard item on each acquire and renewal and removes them on release.
+	// LockWait then polls one shard item with cheap reads, and only tries the
+	// lock item itself when the shard shows the lock free. This costs the
+	// holder Shards more writes per renewal, in batches of 25.
+	Shards int
+
+	// Trace, if set, is called after each dynamodb operation made to acquire,
+	// renew or release the lock, as selected by Sampling, nil for all of them.
+	// It is called while the mutex is locked so must not call its methods.
+	Trace    func(TraceEvent)
+	Sampling *Sampling
+
+	// Metrics, if set, receives the counts and latencies of the operations.
+	Metrics Metrics
+
+	// Logger receives renewal failures, lost leases and takeovers of
+	// expired locks. It defaults to slog.Default().
+	Logger Logger
+
+	// Lifecycle has the callbacks called as the lease changes.
+	Lifecycle Lifecycle
+
+	// ShouldRenew, if set, is consulted before each background renewal,
+	// for example to check that a job has advanced since the previous one.
+	// If it returns false the renewal is skipped, so a stuck but alive
+	// holder loses the lock once the lease lapses and another can take over.
+	ShouldRenew func() bool
+
+	// OnRenewError, if set, is called when the background renewal fails,
+	// with the number of similar errors since the previous call. Repeated
+	// errors, for example during a DynamoDB outage, are reported at most once
+	// per ErrorInterval, defaulting to a minute. If not set errors are logged
+	// with the Logger. Renewal is retried until the lease lapses.
+	OnRenewError  func(err error, suppressed int)
+	ErrorInterval time.Duration
+
+	// MaxHoldTime, if set, is how long the lock may be held. Once reached the
+	// lease is not renewed anymore and Lost is signaled with ErrMaxHoldTime,
+	// so a wedged process can not hold the lock forever. The item is left to
+	// lapse, the critical section should stop before then.
+	MaxHoldTime time.Duration
+
+	// MaxRenewFailures, if set, is the number of consecutive failed background
+	// renewals after which the lock is considered lost, before the lease
+	// lapses, so the application stops relying on a lock it may not keep.
+	// Err then returns the last renewal error. By default failures are
+	// tolerated, and retried, until the lease lapses.
+	MaxRenewFailures int
+
+	// RecordOwner also stores the runtime identity of this process, the EC2
+	// instance id, ECS task arn or Kubernetes pod, on the lock item so who
+	// holds the lock maps directly to infrastructure. The metadata endpoints
+	// are queried once per process, which takes up to a second when not
+	// running on that infrastructure. The hostname, pid and start time of the
+	// process are always recorded.
+	RecordOwner bool
+
+	// OwnerName is recorded on the lock item with the identity of the
+	// process, for example the job or user holding the lock.
+	OwnerName string
+
+	// WaitOnStream makes LockWait park on the table's DynamoDB stream and
+	// retry as soon as the lock item is removed, instead of only after the
+	// holder's lease would expire. The table must have a stream enabled
+	// that includes keys.
+	WaitOnStream bool
 
 	name     string
 	fullname string
 	uuid     string
+
+	// renewed is the local time, including its monotonic clock reading,
+	// taken just before the last successful create or update was sent.
+	// ttl is the lease duration that was requested at that time. Local
+	// decisions about the lease use these, never the wall clock expiry
+	// stored on dynamodb, so they are not affected by clock adjustments.
+	renewed time.Time
+	ttl     time.Duration
+
+	mode         Mode // resolved from Mode when locking
+	jittered     bool
+	errors       errorReporter
+	owner        *Owner
+	payload      []byte
+	fence        int64
+	steppingDown bool
+	heir         string
+	limit        *HoldLimit
+	slot         bool
+	acquired     time.Time
+	done         chan struct{}
+	session      *Session
+	extended     time.Time
+	failures     int
+	callbacks    []func()
+	dispatching  bool
+	backend      Backend
+	lost         chan struct{}
+	lostErr      error
+	others       []*LockInfo
+	shadowed     bool
+	expiring     *time.Timer
+	previous     *LockInfo
+	conflicts    []time.Time
+	lastHolder   *LockInfo
+}
+
+// LockInfo describes a lock item stored on dynamodb.
+type LockInfo struct {
+	// Name is the name of the item, including the prefix.
+	Name    string
+	UUID    string
+	Expires time.Time
+
+	// Owner is the identity of the holder, if recorded.
+	Owner *Owner
+
+	// Payload is the encoded payload of the holder, if any.
+	Payload []byte
+
+	// Reason is why the lock is held or, on a tombstone, was force released.
+	Reason string
+
+	// Metadata are the caller defined attributes of the holder, if any.
+	Metadata map[string]string
+
+	// Fence is the fencing token of the holder, if it uses Fencing.
+	Fence int64
+
+	// SteppingDown is true if the holder is gracefully resigning.
+	SteppingDown bool
+
+	// Heir is the designated successor of the holder, if any.
+	Heir string
+
+	// ReleasedAt is set if the item is a tombstone, the lock was released
+	// at that time by the holder identified by the UUID and Owner, or force
+	// released. It is also set on the item a holder with an heir leaves on
+	// release. HeldFor is how long it was held, if known. See
+	// Mutex.Tombstones.
+	ReleasedAt time.Time
+	HeldFor    time.Duration
+
+	// Attributes contains any other attributes on the item,
+	// for example those written by another tool or version.
+	Attributes map[string]*dynamodb.AttributeValue
 }
 
 // New creates a new mutex using dynamodb as the distributed store.
-// If context is canceled the lock will be released.
-func New(ctx context.Context, name string) *Mutex {
+// If context is canceled the lock will be released and can not be taken
+// again. The mutex can otherwise be locked again after it is unlocked.
+// The options are applied in order.
+func New(ctx context.Context, name string, opts ...Option) *Mutex {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	ctx, cancel := context.WithCancel(ctx)
-	return &Mutex{
+
+	m := &Mutex{
 		ctx:    ctx,
-		cancel: cancel,
+		cancel: func() {},
+
+		TableName:    DefaultTableName,
+		TTL:          DefaultTTL,
+		ExpiryFormat: DefaultExpiryFormat,
+		Grace:        DefaultGrace,
 
-		TableName: DefaultTableName,
-		TTL:       DefaultTTL,
+		RetryInterval: DefaultRetryInterval,
 
 		name:     name,
-		fullname: "ddblock-" + name,
-		uuid:     fmt.Sprintf("%d", time.Now().UnixNano()),
+		fullname: DefaultPrefix + name,
+		uuid:     newUUID(),
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// newUUID returns a new token identifying a lease, a random version 4
+// uuid so tokens do not collide across hosts or with skewed clocks.
+func newUUID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic("ddbmutex: reading random token: " + err.Error())
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 // Name returns the name of the mutex which should uniquely identify
@@ -76,97 +425,524 @@ func (m *Mutex) Name() string {
 	return m.name
 }
 
-// Lock creates the lock item on dynamodb. The lock is renewed every TTL/2
-// to make sure the lock is kept. A nil error indicates success. An error
-// of ErrConflict means someone else already has the lock. Another error
-// indicates an network or dynamo error.
+// ItemName returns the name of the lock item, the name with its prefix.
+func (m *Mutex) ItemName() string {
+	return m.fullname
+}
+
+// Lock blocks until the lock is acquired, like sync.Mutex, or the context
+// of the mutex is done. It is LockWait with the mutex's context.
 func (m *Mutex) Lock() error {
-	go func() {
-		for m.ctx.Err() == nil {
-			select {
-			case <-time.After(m.cleanTTL() / 2):
-			case <-m.ctx.Done():
-				m.Unlock()
-				return
-			}
+	_, err := m.LockWait(m.ctx)
+	return err
+}
+
+// TryLock creates the lock item on dynamodb without waiting. The lock is
+// renewed every HeartbeatInterval to make sure the lock is kept. A nil error
+// indicates success. An error matching ErrConflict means someone else already
+// has the lock. Another error indicates an network or dynamo error.
+func (m *Mutex) TryLock() error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
 
-			m.update()
+	if err := m.jitter(m.ctx); err != nil {
+		return err
+	}
+
+	took, err := m.takeSlot()
+	if err != nil {
+		return err
+	}
+
+	err = m.create()
+	if err != nil {
+		if took {
+			m.lk.Lock()
+			m.releaseSlot()
+			m.lk.Unlock()
+		}
+
+		return err
+	}
+
+	m.startLease()
+	return nil
+}
+
+// startLease records the start of a new lease, if the lock was not already
+// held, and starts renewing it in the background.
+func (m *Mutex) startLease() {
+	m.lk.Lock()
+	fresh := m.acquired.IsZero()
+	ctx := m.ctx
+	if fresh {
+		// a new lease
+		m.acquired = time.Now()
+		m.lostErr = nil
+		m.leaseChannels()
+
+		if m.session != nil && !m.OneShot {
+			m.session.add(m)
 		}
-	}()
 
-	return m.create()
+		ctx, m.cancel = context.WithCancel(m.ctx)
+	}
+	m.lk.Unlock()
+
+	if !fresh || m.ManualRenew || m.OneShot {
+		// renewed by the running heartbeat, or by the caller
+		return
+	}
+
+	go pprof.Do(ctx, m.labels(), func(ctx context.Context) { m.heartbeat(ctx) })
+}
+
+// stopHeartbeat stops the renewal of the current lease.
+func (m *Mutex) stopHeartbeat() {
+	m.lk.Lock()
+	cancel := m.cancel
+	m.cancel = func() {}
+	m.lk.Unlock()
+
+	cancel()
+}
+
+// labels are the pprof labels of the goroutines working for the mutex,
+// so profiles attribute background renewals to their lock.
+func (m *Mutex) labels() pprof.LabelSet {
+	return pprof.Labels("ddblock_lock", m.name, "ddblock_table", m.TableName)
+}
+
+// Renew extends the lease to a full TTL from now. It is only needed with
+// ManualRenew, otherwise the lease is renewed in the background. ErrNotHeld
+// is returned if the lock is not held and ErrLockLost if someone else took
+// the lock after the lease lapsed.
+func (m *Mutex) Renew() error {
+	return m.update()
+}
+
+// Previous returns the expired lock item that was replaced by the last
+// successful acquisition. It is nil if the lock was free when acquired.
+// The new holder can use this to log or clean up after the previous one.
+func (m *Mutex) Previous() *LockInfo {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.previous
+}
+
+// Token returns the token identifying the current, or next, lease of the
+// mutex on the lock item. It changes for every lease and is empty between
+// the end of a lease and the next lock attempt.
+func (m *Mutex) Token() string {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.uuid
+}
+
+// IsHeld reports whether this mutex believes it holds the lock, since the
+// lease was acquired and has not been released, lost or lapsed, and since
+// when. It is local state, use Verify to check the lock item.
+func (m *Mutex) IsHeld() (bool, time.Time) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" || m.remaining() <= 0 {
+		return false, time.Time{}
+	}
+
+	return true, m.acquired
+}
+
+// TimeToExpiry returns how much of the lease is left, measured with the
+// monotonic clock since the last successful acquisition or renewal, zero if
+// the lock is not held. A long critical section can check it is still safe
+// before a dangerous operation, leaving a margin for clock drift.
+func (m *Mutex) TimeToExpiry() time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" {
+		return 0
+	}
+
+	if d := m.remaining(); d > 0 {
+		return d
+	}
+
+	return 0
 }
 
 // Unlock deletes the lock from dynamodb and allows other go get it.
+// ErrLockLost is returned if someone else took the lock after
+// our lease lapsed. If the delete fails for another reason it is
+// retried in the background, see ReleaseRetries.
 func (m *Mutex) Unlock() error {
-	m.cancel()
+	_, err := m.Release()
+	return err
+}
+
+// Ownership is the state of the lock when it was released.
+type Ownership int
+
+const (
+	// NotHeld means the lock was not held, it was never
+	// locked or was already unlocked.
+	NotHeld Ownership = iota
+
+	// Intact means the lease was still valid when released.
+	Intact
+
+	// Expired means the lease had lapsed before it was released,
+	// but nobody else took the lock in the meantime.
+	Expired
+
+	// Taken means someone else took the lock after the lease lapsed.
+	// Release returns ErrLockLost along with it.
+	Taken
+)
+
+// Release is like Unlock but also reports whether the lock was still
+// owned when released. Anything except Intact means the work done while
+// holding the lock may not have been protected and should be flagged.
+func (m *Mutex) Release() (Ownership, error) {
+	m.stopHeartbeat()
 	return m.delete()
 }
 
+// Abandon stops renewing the lock and forgets it without deleting the item,
+// which remains until the lease lapses. Use it when issuing a delete is
+// not possible or not wanted, for example when the credentials have already
+// been revoked during shutdown.
+func (m *Mutex) Abandon() {
+	m.lk.Lock()
+	if m.uuid != "" && !m.renewed.IsZero() {
+		m.audit(AuditAbandon, nil)
+	}
+	m.clearLease()
+	m.lk.Unlock()
+
+	// the heartbeat finds nothing to unlock
+	m.stopHeartbeat()
+}
+
 func (m *Mutex) create() error {
+	owner := m.identity()
+
 	m.lk.Lock()
 	defer m.lk.Unlock()
 
+	if m.uuid == "" {
+		// the previous lease was released or lost, start a new one.
+		m.uuid = newUUID()
+	}
+
+	if err := m.checkPolicy(); err != nil {
+		return err
+	}
+
+	m.owner = owner
+	if m.backend != nil {
+		return m.backendCreate()
+	}
+
+	m.mode = m.resolveMode()
+	if m.mode == Advisory {
+		return m.putAdvisory(OpAcquire)
+	}
+
+	var fence string
+	if m.Fencing {
+		var err error
+		if fence, err = m.nextFence(); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now()
+	ttl := m.cleanTTL()
+	params := m.createInput(now, ttl)
+	if m.Fencing {
+		m.fenceCondition(params, fence)
+	}
+
+	start := time.Now()
+	resp, err := m.db().PutItemWithContext(m.opContext(), params)
+	m.trace(OpAcquire, start, err)
+	if err != nil {
+		m.fence = 0
+		var holder *LockInfo
+		if e, ok := err.(*dynamodb.ConditionalCheckFailedException); ok && len(e.Item) > 0 {
+			holder = m.Schema.lockInfo(e.Item)
+		}
+
+		if IsAquireError(err) {
+			m.recordConflict(now, holder)
+		}
+
+		if m.mode == Shadow && IsAquireError(err) {
+			// pretend to hold the lock without touching the item
+			shadowOutcome("conflict")
+			m.shadowed = true
+			m.renewed, m.ttl = now, ttl
+			return nil
+		}
+
+		if IsAquireError(err) {
+			return &ConflictError{Holder: holder, Err: err}
+		}
+
+		return wrapError(err)
+	}
+
+	m.created(now, ttl, params.Item, resp.Attributes)
+	return nil
+}
+
+// createInput returns the put creating the lock item, or taking it over if
+// it has expired, with a lease of ttl from now. Must be called with m.lk held.
+func (m *Mutex) createInput(now time.Time, ttl time.Duration) *dynamodb.PutItemInput {
+	// the existing item must have expired before this to be taken over.
+	cutoff := now.Add(-m.Grace)
 	params := &dynamodb.PutItemInput{
 		TableName: &m.TableName,
-		Item: map[string]*dynamodb.AttributeValue{
-			"name": {
-				S: &m.fullname,
-			},
-			"expires": {
-				N: aws.String(strconv.FormatInt(now.Add(m.cleanTTL()).UnixNano(), 10)),
-			},
-			"uuid": {
-				S: &m.uuid,
-			},
-		},
-		ConditionExpression: aws.String("#name <> :name OR (#name = :name AND #exp < :exp)"),
+		Item:      m.item(now.Add(ttl)),
 		ExpressionAttributeNames: map[string]*string{
-			"#name": &nameString,
-			"#exp":  &expiresString,
+			"#name":     aws.String(m.Schema.keyName()),
+			"#exp":      aws.String(m.Schema.expiresName()),
+			"#released": &releasedAtString,
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":name": {
 				S: &m.fullname,
 			},
-			":exp": {
-				N: aws.String(strconv.FormatInt(now.UnixNano(), 10)),
+			":cutoff": {
+				N: aws.String(strconv.FormatInt(expiresCutoff, 10)),
+			},
+			":expns": {
+				N: aws.String(strconv.FormatInt(cutoff.UnixNano(), 10)),
+			},
+			":exps": {
+				N: aws.String(strconv.FormatInt(cutoff.Unix(), 10)),
 			},
 		},
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllOld),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
 	}
+	// a tombstone is free right away, the previous holder released it.
+	params.ConditionExpression = aws.String("#name <> :name OR (#name = :name AND " +
+		"(attribute_exists(#released) OR " + expiredCondition + ") AND (" + m.heirCondition(params, cutoff) + "))")
 
-	_, err := getSvc().PutItem(params)
-	return err
+	return params
+}
+
+// created records the lease of the item written with a ttl from now,
+// old is the expired item it replaced, if any. Must be called with m.lk held.
+func (m *Mutex) created(now time.Time, ttl time.Duration, item, old map[string]*dynamodb.AttributeValue) {
+	m.shadowed = false
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+	if m.Shards > 0 {
+		m.publishShards(m.ctx, item, false)
+	}
+
+	// the old item is only a takeover if it is a lease that expired,
+	// not an item its holder, or a ForceRelease, left on release
+	m.previous = nil
+	if len(old) > 0 {
+		if info := m.Schema.lockInfo(old); info.UUID != "" && info.ReleasedAt.IsZero() {
+			m.previous = info
+		}
+	}
+
+	if m.previous != nil {
+		m.logTakeover()
+		m.audit(AuditSteal, m.previous)
+	} else {
+		m.audit(AuditAcquire, nil)
+	}
+
+	if m.mode == Shadow {
+		if m.previous != nil {
+			shadowOutcome("stolen")
+		} else {
+			shadowOutcome("acquired")
+		}
+	}
+}
+
+// item returns the lock item held by this mutex expiring at the given time.
+// Must be called with m.lk held.
+func (m *Mutex) item(expires time.Time) map[string]*dynamodb.AttributeValue {
+	item := m.Schema.key(m.fullname)
+	item[m.Schema.expiresName()] = &dynamodb.AttributeValue{
+		N: aws.String(m.formatExpires(expires)),
+	}
+	item[m.Schema.uuidName()] = &dynamodb.AttributeValue{
+		S: aws.String(m.uuid),
+	}
+	item[ttlString] = ttlAttribute(expires)
+	if m.Schema.expiryIndex() != "" {
+		item[expiryPartitionString] = &dynamodb.AttributeValue{S: aws.String(expiryPartition)}
+	}
+
+	if m.owner != nil {
+		item[ownerString] = m.owner.attribute()
+	}
+
+	if len(m.payload) > 0 {
+		item[payloadString] = payloadAttribute(m.payload)
+	}
+
+	if m.steppingDown {
+		item[steppingDownString] = steppingDownAttribute()
+	}
+
+	if m.heir != "" {
+		item[heirString] = &dynamodb.AttributeValue{S: aws.String(m.heir)}
+	}
+
+	if m.Reason != "" {
+		item[reasonString] = &dynamodb.AttributeValue{S: aws.String(m.Reason)}
+	}
+
+	if len(m.Metadata) > 0 {
+		item[metadataString] = metadataAttribute(m.Metadata)
+	}
+
+	if m.fence > 0 {
+		item[fenceString] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(m.fence, 10))}
+	}
+
+	return item
+}
+
+// expiredCondition is true if the #exp attribute is before the cutoff time,
+// :expns and :exps, for either expiry format.
+const expiredCondition = "((#exp >= :cutoff AND #exp < :expns) OR (#exp < :cutoff AND #exp < :exps))"
+
+// formatExpires encodes the expiry using the mutex's ExpiryFormat.
+// Seconds are rounded up so the lock is never stored as expiring early.
+func (m *Mutex) formatExpires(t time.Time) string {
+	if m.ExpiryFormat == ExpiresSeconds {
+		sec := t.Unix()
+		if t.Nanosecond() > 0 {
+			sec++
+		}
+
+		return strconv.FormatInt(sec, 10)
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// parseExpires decodes an expires attribute written in either format.
+func parseExpires(n string) (time.Time, error) {
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if v < expiresCutoff {
+		return time.Unix(v, 0), nil
+	}
+
+	return time.Unix(0, v), nil
+}
+
+// lockInfo converts a lock item into its LockInfo. Attributes
+// that can not be decoded are left as their zero values.
+func (s *Schema) lockInfo(item map[string]*dynamodb.AttributeValue) *LockInfo {
+	info := &LockInfo{}
+	for k, v := range item {
+		switch k {
+		case s.keyName():
+			info.Name = aws.StringValue(v.S)
+		case s.uuidName():
+			info.UUID = aws.StringValue(v.S)
+		case s.expiresName():
+			info.Expires, _ = parseExpires(aws.StringValue(v.N))
+		case ownerString:
+			info.Owner = ownerFromAttribute(v)
+		case payloadString:
+			info.Payload = payloadFromAttribute(v)
+		case steppingDownString:
+			info.SteppingDown = aws.BoolValue(v.BOOL)
+		case heirString:
+			info.Heir = aws.StringValue(v.S)
+		case reasonString:
+			info.Reason = aws.StringValue(v.S)
+		case metadataString:
+			info.Metadata = metadataFromAttribute(v)
+		case fenceString:
+			info.Fence, _ = strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		case s.sortKeyName(), expiryPartitionString:
+			// the same for every lock item
+		case ttlString:
+			// only for cleanup, Expires is authoritative
+		case releasedAtString:
+			info.ReleasedAt, _ = parseExpires(aws.StringValue(v.N))
+		case heldForString:
+			n, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+			info.HeldFor = time.Duration(n)
+		default:
+			if info.Attributes == nil {
+				info.Attributes = make(map[string]*dynamodb.AttributeValue)
+			}
+			info.Attributes[k] = v
+		}
+	}
+
+	return info
 }
 
 func (m *Mutex) update() error {
+	return m.updateContext(m.opContext())
+}
+
+func (m *Mutex) updateContext(ctx context.Context) error {
 	m.lk.Lock()
 	defer m.lk.Unlock()
 
-	if m.uuid == "" {
-		// has already been unlocked
-		return nil
+	if m.uuid == "" || m.renewed.IsZero() {
+		// never locked or has already been unlocked
+		return ErrNotHeld
+	}
+
+	if m.OneShot {
+		return ErrOneShot
+	}
+
+	if m.holdRemaining() <= 0 {
+		m.audit(AuditAbandon, nil)
+		m.loseLease(ErrMaxHoldTime)
+		return ErrMaxHoldTime
+	}
+
+	if m.backend != nil {
+		return m.backendUpdate()
+	}
+
+	if m.mode == Advisory {
+		return m.putAdvisory(OpRenew)
 	}
 
 	now := time.Now()
+	ttl := m.renewalTTL()
+	if m.shadowed {
+		m.renewed, m.ttl = now, ttl
+		return nil
+	}
+
 	params := &dynamodb.PutItemInput{
-		TableName: &m.TableName,
-		Item: map[string]*dynamodb.AttributeValue{
-			"name": {
-				S: &m.fullname,
-			},
-			"expires": {
-				N: aws.String(strconv.FormatInt(now.Add(m.cleanTTL()).UnixNano(), 10)),
-			},
-			"uuid": {
-				S: &m.uuid,
-			},
-		},
+		TableName:           &m.TableName,
+		Item:                m.item(now.Add(ttl)),
 		ConditionExpression: aws.String("#name = :name AND #uuid = :uuid"),
 		ExpressionAttributeNames: map[string]*string{
-			"#name": &nameString,
-			"#uuid": &uuidString,
+			"#name": aws.String(m.Schema.keyName()),
+			"#uuid": aws.String(m.Schema.uuidName()),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":name": {
@@ -178,64 +954,386 @@ func (m *Mutex) update() error {
 		},
 	}
 
-	_, err := getSvc().PutItem(params)
+	start := time.Now()
+	_, err := m.db().PutItemWithContext(ctx, params)
+	m.trace(OpRenew, start, err)
+	if IsAquireError(err) {
+		if m.mode == Shadow {
+			shadowOutcome("lost")
+			m.shadowed = true
+			m.renewed, m.ttl = now, ttl
+			return nil
+		}
+
+		m.audit(AuditLost, nil)
+		m.loseLease(ErrLockLost)
+		return ErrLockLost
+	}
+
 	if err != nil {
-		panic(err)
+		return wrapError(err)
 	}
-	return err
+
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+	if m.Shards > 0 {
+		m.publishShards(m.ctx, params.Item, false)
+	}
+
+	return nil
 }
 
-func (m *Mutex) delete() error {
+func (m *Mutex) delete() (Ownership, error) {
 	m.lk.Lock()
 	defer m.lk.Unlock()
 
-	if m.uuid == "" {
-		// has already been unlocked successfully
-		return nil
+	if m.uuid == "" || m.renewed.IsZero() {
+		// never locked or has already been unlocked successfully
+		return NotHeld, nil
+	}
+
+	ownership := Intact
+	if m.remaining() <= 0 {
+		ownership = Expired
+	}
+
+	if m.backend != nil {
+		return m.backendDelete(ownership)
+	}
+
+	if m.mode == Advisory {
+		return ownership, m.removeAdvisory()
+	}
+
+	if m.shadowed {
+		// the item belongs to someone else
+		m.clearLease()
+		return ownership, nil
 	}
 
 	params := &dynamodb.DeleteItemInput{
-		TableName: &m.TableName,
-		Key: map[string]*dynamodb.AttributeValue{
-			"name": {
-				S: &m.fullname,
-			},
-		},
+		TableName:           &m.TableName,
+		Key:                 m.Schema.key(m.fullname),
 		ConditionExpression: aws.String("#name = :name AND #uuid = :uuid"),
 		ExpressionAttributeNames: map[string]*string{
-			"#name": aws.String("name"),
-			"#uuid": aws.String("uuid"),
+			"#name": aws.String(m.Schema.keyName()),
+			"#uuid": aws.String(m.Schema.uuidName()),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":name": {
 				S: &m.fullname,
 			},
 			":uuid": {
-				S: &m.uuid,
+				S: aws.String(m.uuid),
 			},
 		},
 	}
 
-	_, err := getSvc().DeleteItem(params)
-	if IsAquireError(err) || err == nil {
-		m.uuid = ""
-		return nil
+	release := func() error {
+		_, err := m.db().DeleteItemWithContext(m.opContext(), params)
+		return err
 	}
 
-	return err
+	if m.heir != "" || m.Tombstones {
+		put := m.expireInPlace()
+		release = func() error {
+			_, err := m.db().PutItemWithContext(m.opContext(), put)
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := release()
+	m.trace(OpRelease, start, err)
+	if IsAquireError(err) {
+		// The item is gone or belongs to someone else. Only the latter
+		// means our critical section could have overlapped with another.
+		var holder string
+		holder, err = m.holder()
+		if err != nil {
+			return ownership, err
+		}
+
+		if holder != "" {
+			if m.mode == Shadow {
+				shadowOutcome("lost")
+				m.clearLease()
+				return Taken, nil
+			}
+
+			m.audit(AuditLost, nil)
+			m.loseLease(ErrLockLost)
+			return Taken, ErrLockLost
+		}
+
+		// removed by a tool or DynamoDB TTL, so it was expired.
+		if ownership == Intact {
+			m.audit(AuditForceRelease, nil)
+		} else {
+			m.audit(AuditRelease, nil)
+		}
+
+		m.clearLease()
+		return Expired, nil
+	}
+
+	if err != nil {
+		if !m.queueRelease(release) {
+			return ownership, wrapError(err)
+		}
+
+		// retried in the background, the lease is forgotten now
+	}
+
+	if m.Shards > 0 {
+		// the context has been canceled by Unlock
+		m.publishShards(context.Background(), nil, true)
+	}
+
+	m.audit(AuditRelease, nil)
+	m.clearLease()
+	return ownership, nil
+}
+
+// clearLease forgets the lease after an unlock or when it is lost.
+// Must be called with m.lk held.
+func (m *Mutex) clearLease() {
+	m.uuid = ""
+	m.renewed = time.Time{}
+	m.extended = time.Time{}
+	m.failures = 0
+	m.cancel()
+	m.cancel = func() {}
+	m.others = nil
+	m.shadowed = false
+	m.steppingDown = false
+	m.heir = ""
+	m.fence = 0
+	m.releaseSlot()
+	m.disarmExpiring()
+
+	if !m.acquired.IsZero() {
+		recordHold(m.name, time.Since(m.acquired))
+		m.acquired = time.Time{}
+
+		if m.Lifecycle.OnReleased != nil && (m.lost == nil || !closed(m.lost)) {
+			m.notify(m.Lifecycle.OnReleased)
+		}
+	}
+
+	if m.done != nil && !closed(m.done) {
+		close(m.done)
+	}
+
+	if m.session != nil {
+		m.session.remove(m)
+	}
 }
 
-// IsAquireError checks to see if the error returned by Lock
+// holder returns the uuid of the current holder of the lock item,
+// or an empty string if the item does not exist.
+func (m *Mutex) holder() (string, error) {
+	if m.backend != nil {
+		lease, err := m.backend.Get(context.Background(), m.fullname)
+		if err != nil || lease == nil {
+			return "", err
+		}
+
+		return lease.UUID, nil
+	}
+
+	params := &dynamodb.GetItemInput{
+		TableName:      &m.TableName,
+		Key:            m.Schema.key(m.fullname),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	resp, err := m.db().GetItem(params)
+	if err != nil {
+		return "", wrapError(err)
+	}
+
+	if v := resp.Item[m.Schema.uuidName()]; v != nil {
+		return aws.StringValue(v.S), nil
+	}
+
+	return "", nil
+}
+
+// IsAquireError checks to see if the error returned by TryLock
 // is the result of someone else holding the lock. If false
 // and err != nil, there was some sort of config or network issue.
+// It is the same as errors.Is(err, ErrConflict) for errors returned by
+// the mutex, but also matches raw conditional check failures.
 func IsAquireError(err error) bool {
-	if e, ok := err.(awserr.Error); ok {
+	if errors.Is(err, ErrConflict) {
+		return true
+	}
+
+	var e awserr.Error
+	if errors.As(err, &e) {
 		return e.Code() == "ConditionalCheckFailedException"
 	}
 
 	return false
 }
 
+// ConflictError is returned by TryLock when someone else holds the lock.
+// It matches ErrConflict with errors.Is.
+type ConflictError struct {
+	// Holder is the lock item of the current holder, as read by the failed
+	// condition. It is nil if not known, for example with a Backend.
+	Holder *LockInfo
+
+	// Err is the underlying conditional check failure.
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	if e.Holder == nil {
+		return ErrConflict.Error()
+	}
+
+	return fmt.Sprintf("%v %s until %s", ErrConflict, e.Holder.UUID, e.Holder.Expires.Format(time.RFC3339Nano))
+}
+
+// Is makes the error match ErrConflict.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Unwrap returns the underlying error.
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// ExpiresIn returns how long until the holder's lease expires, by the local
+// clock, if it is not renewed. It is zero if the holder is not known.
+func (e *ConflictError) ExpiresIn() time.Duration {
+	if e.Holder == nil {
+		return 0
+	}
+
+	return time.Until(e.Holder.Expires)
+}
+
+// wrapError makes the error of a dynamodb request match the sentinel errors
+// with errors.Is, while the aws error is still available with errors.As.
+func wrapError(err error) error {
+	var e awserr.Error
+	if !errors.As(err, &e) {
+		return err
+	}
+
+	switch e.Code() {
+	case "ConditionalCheckFailedException":
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	case "ResourceNotFoundException":
+		return fmt.Errorf("%w: %w", ErrTableMissing, err)
+	}
+
+	return err
+}
+
+// remaining returns how much of the lease is left based on the monotonic
+// time elapsed since the last successful renewal. It is zero or negative
+// if the lease has lapsed.
+func (m *Mutex) remaining() time.Duration {
+	if m.renewed.IsZero() {
+		return 0
+	}
+
+	return m.ttl - time.Since(m.renewed)
+}
+
+// DefaultHeartbeatJitter is the HeartbeatJitter of a mutex if not set.
+var DefaultHeartbeatJitter = 0.1
+
+// nextRenewal returns how long to wait before renewing the lease
+// so it is refreshed half way through the current ttl, less the jitter.
+func (m *Mutex) nextRenewal() time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	interval := m.HeartbeatInterval
+	if interval <= 0 || interval >= m.ttl {
+		interval = m.ttl / 2
+	}
+
+	d := m.remaining() - (m.ttl - interval) - heartbeatJitter(m.HeartbeatJitter, interval)
+	if hold := m.holdRemaining(); hold < d {
+		// wake up to give up the lock on time
+		d = hold
+	}
+
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
+
+// holdRemaining returns how long the lock may still be held under the
+// MaxHoldTime. Must be called with m.lk held.
+func (m *Mutex) holdRemaining() time.Duration {
+	if m.MaxHoldTime <= 0 || m.acquired.IsZero() {
+		return math.MaxInt64
+	}
+
+	return m.MaxHoldTime - time.Since(m.acquired)
+}
+
+// heartbeatJitter returns a random part, up to the fraction, of the interval.
+func heartbeatJitter(fraction float64, interval time.Duration) time.Duration {
+	if fraction == 0 {
+		fraction = DefaultHeartbeatJitter
+	}
+
+	if fraction <= 0 {
+		return 0
+	}
+
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	return time.Duration(rand.Float64() * fraction * float64(interval))
+}
+
+// armExpiring (re)starts the timer that calls OnExpiring based on the
+// current lease. Must be called with m.lk held.
+func (m *Mutex) armExpiring() {
+	m.disarmExpiring()
+	if m.OnExpiring == nil {
+		return
+	}
+
+	margin := m.ExpiringMargin
+	if margin <= 0 {
+		margin = m.ttl / 4
+	}
+
+	renewed := m.renewed
+	m.expiring = time.AfterFunc(m.remaining()-margin, func() {
+		m.lk.Lock()
+		current := m.renewed == renewed
+		m.lk.Unlock()
+
+		// skip if a renewal happened while this was firing
+		if current {
+			m.OnExpiring()
+		}
+	})
+}
+
+// disarmExpiring stops the OnExpiring timer. Must be called with m.lk held.
+func (m *Mutex) disarmExpiring() {
+	if m.expiring != nil {
+		m.expiring.Stop()
+		m.expiring = nil
+	}
+}
+
 func (m *Mutex) cleanTTL() time.Duration {
 	ttl := m.TTL
 	if ttl == 0 {
@@ -249,24 +1347,35 @@ func (m *Mutex) cleanTTL() time.Duration {
 	return ttl
 }
 
-var (
-	svc   *dynamodb.DynamoDB
-	svcLk sync.Mutex
-)
+func init() {
+	loadEnv()
+}
 
-// getSvc enables the initialization on first read (ie. after config has been parsed),
-// kind of like a singleton class.
-func getSvc() *dynamodb.DynamoDB {
-	svcLk.Lock()
-	defer svcLk.Unlock()
+// loadEnv applies the DDBLOCK_* environment variables to the package
+// defaults. DDBLOCK_TTL is a Go duration, like "90s", or a whole number
+// of seconds. An empty DDBLOCK_PREFIX removes the prefix.
+func loadEnv() {
+	if v := os.Getenv("DDBLOCK_TABLE"); v != "" {
+		DefaultTableName = v
+	}
+
+	if v := os.Getenv("DDBLOCK_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			DefaultTTL = d
+		} else if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			DefaultTTL = time.Duration(n) * time.Second
+		}
+	}
 
-	if svc == nil {
-		c := aws.NewConfig().
-			WithMaxRetries(3).
-			WithRegion("us-east-1")
+	if v, ok := os.LookupEnv("DDBLOCK_PREFIX"); ok {
+		DefaultPrefix = v
+	}
 
-		svc = dynamodb.New(session.New(c))
+	if v := os.Getenv("DDBLOCK_REGION"); v != "" {
+		DefaultRegion = v
 	}
 
-	return svc
+	if v := os.Getenv("DDBLOCK_ENDPOINT"); v != "" {
+		DefaultEndpoint = v
+	}
 }
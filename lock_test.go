@@ -0,0 +1,368 @@
+package ddblock
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// lockItem returns a lock item held by uuid with the expires attribute,
+// with attrs adding optional attributes, alternating names and values.
+func lockItem(name, uuid, expires string, attrs ...string) fakeItem {
+	it := fakeItem{
+		"name":    {S: aws.String(name)},
+		"uuid":    {S: aws.String(uuid)},
+		"expires": {N: aws.String(expires)},
+	}
+
+	for i := 0; i < len(attrs); i += 2 {
+		if _, err := strconv.ParseInt(attrs[i+1], 10, 64); err == nil {
+			it[attrs[i]] = &dynamodb.AttributeValue{N: aws.String(attrs[i+1])}
+		} else {
+			it[attrs[i]] = &dynamodb.AttributeValue{S: aws.String(attrs[i+1])}
+		}
+	}
+
+	return it
+}
+
+func nanos(t time.Time) string   { return strconv.FormatInt(t.UnixNano(), 10) }
+func seconds(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+
+func TestParseExpires(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want time.Time
+	}{
+		{name: "nanoseconds", in: "1600000000123456789", want: time.Unix(0, 1600000000123456789)},
+		{name: "seconds", in: "1600000000", want: time.Unix(1600000000, 0)},
+		{name: "at cutoff", in: "1000000000000", want: time.Unix(0, expiresCutoff)},
+		{name: "below cutoff", in: "999999999999", want: time.Unix(999999999999, 0)},
+		{name: "zero", in: "0", want: time.Unix(0, 0)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseExpires(tc.in)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !got.Equal(tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := parseExpires("soon"); err == nil {
+		t.Errorf("parse of a non number: expected an error")
+	}
+}
+
+func TestFormatExpires(t *testing.T) {
+	cases := []struct {
+		name   string
+		format ExpiryFormat
+		in     time.Time
+		want   string
+	}{
+		{name: "nanoseconds", format: ExpiresNanos, in: time.Unix(1600000000, 5), want: "1600000000000000005"},
+		{name: "whole seconds", format: ExpiresSeconds, in: time.Unix(1600000000, 0), want: "1600000000"},
+		{name: "rounded up", format: ExpiresSeconds, in: time.Unix(1600000000, 5), want: "1600000001"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New(context.Background(), "format")
+			m.ExpiryFormat = tc.format
+
+			got := m.formatExpires(tc.in)
+			if got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+
+			back, _ := parseExpires(got)
+			if back.Before(tc.in) {
+				t.Errorf("round trip: %v is before %v", back, tc.in)
+			}
+		})
+	}
+}
+
+func TestMutexAcquireConditions(t *testing.T) {
+	name := New(context.Background(), "conditions").ItemName()
+	now := time.Now()
+
+	cases := []struct {
+		name      string
+		existing  fakeItem
+		candidate string
+		conflict  bool
+		previous  bool
+	}{
+		{name: "free"},
+		{
+			name:     "held nanoseconds",
+			existing: lockItem(name, "other", nanos(now.Add(time.Minute))),
+			conflict: true,
+		},
+		{
+			name:     "held seconds",
+			existing: lockItem(name, "other", seconds(now.Add(time.Minute))),
+			conflict: true,
+		},
+		{
+			name:     "expired nanoseconds",
+			existing: lockItem(name, "other", nanos(now.Add(-time.Minute))),
+			previous: true,
+		},
+		{
+			name:     "expired seconds",
+			existing: lockItem(name, "other", seconds(now.Add(-time.Minute))),
+			previous: true,
+		},
+		{
+			name:     "released",
+			existing: lockItem(name, "other", nanos(now), releasedAtString, nanos(now)),
+		},
+		{
+			name: "tombstone",
+			existing: lockItem(name, "other", nanos(now),
+				releasedAtString, nanos(now), heldForString, strconv.FormatInt(int64(time.Second), 10)),
+		},
+		{
+			name:     "released to an heir",
+			existing: lockItem(name, "other", nanos(now), releasedAtString, nanos(now), heirString, "next"),
+			conflict: true,
+		},
+		{
+			name:      "released to us",
+			existing:  lockItem(name, "other", nanos(now), releasedAtString, nanos(now), heirString, "next"),
+			candidate: "next",
+		},
+		{
+			name:      "released to another heir",
+			existing:  lockItem(name, "other", nanos(now), releasedAtString, nanos(now), heirString, "next"),
+			candidate: "someone",
+			conflict:  true,
+		},
+		{
+			name: "heir window over",
+			existing: lockItem(name, "other", nanos(now.Add(-time.Minute)),
+				releasedAtString, nanos(now.Add(-time.Minute)), heirString, "next"),
+		},
+		{
+			name:     "heir window over seconds",
+			existing: lockItem(name, "other", seconds(now.Add(-time.Minute)), heirString, "next"),
+			previous: true,
+		},
+		{
+			name:     "expired into the heir window",
+			existing: lockItem(name, "other", nanos(now.Add(-time.Second)), heirString, "next"),
+			conflict: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newFakeDB()
+			if tc.existing != nil {
+				db.put(tc.existing)
+			}
+
+			m := New(context.Background(), "conditions", WithClient(db))
+			m.Candidate = tc.candidate
+
+			err := m.TryLock()
+			if tc.conflict {
+				var ce *ConflictError
+				if !IsAquireError(err) || !errors.As(err, &ce) {
+					t.Fatalf("expected a conflict, got %v", err)
+				}
+
+				if ce.Holder == nil || ce.Holder.UUID != "other" {
+					t.Errorf("holder: expected the existing lease, got %v", ce.Holder)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lock: %v", err)
+			}
+			defer m.Unlock()
+
+			if got := aws.StringValue(db.get(name)["uuid"].S); got != m.Token() {
+				t.Errorf("uuid: expected %v, got %v", m.Token(), got)
+			}
+
+			p := m.Previous()
+			if tc.previous && (p == nil || p.UUID != "other") {
+				t.Errorf("previous: expected the expired lease, got %v", p)
+			}
+
+			if !tc.previous && p != nil {
+				t.Errorf("previous: expected none, got %v", p)
+			}
+		})
+	}
+}
+
+func TestMutexUnlockTombstone(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+
+	m1 := New(ctx, "tombstone", WithClient(db))
+	m1.Tombstones = true
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := m1.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	it := db.get(m1.ItemName())
+	if it[releasedAtString] == nil || it[heldForString] == nil {
+		t.Fatalf("tombstone: expected the release to be recorded, got %v", it)
+	}
+
+	m2 := New(ctx, "tombstone", WithClient(db))
+	if err := m2.TryLock(); err != nil {
+		t.Fatalf("lock of a tombstone: %v", err)
+	}
+	defer m2.Unlock()
+
+	if p := m2.Previous(); p != nil {
+		t.Errorf("previous: a tombstone is not a takeover, got %v", p)
+	}
+}
+
+func TestMutexUnlockToHeir(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+
+	m1 := New(ctx, "heir", WithClient(db))
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := m1.Designate("next"); err != nil {
+		t.Fatalf("designate: %v", err)
+	}
+
+	if err := m1.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	other := New(ctx, "heir", WithClient(db))
+	if err := other.TryLock(); !IsAquireError(err) {
+		t.Fatalf("lock during the heir window: expected a conflict, got %v", err)
+	}
+
+	heir := New(ctx, "heir", WithClient(db))
+	heir.Candidate = "next"
+	if err := heir.TryLock(); err != nil {
+		t.Fatalf("lock by the heir: %v", err)
+	}
+	defer heir.Unlock()
+
+	if p := heir.Previous(); p != nil {
+		t.Errorf("previous: a release to the heir is not a takeover, got %v", p)
+	}
+
+	if it := db.get(heir.ItemName()); it[heirString] != nil || it[releasedAtString] != nil {
+		t.Errorf("item: expected the heir's own lease, got %v", it)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := time.Second
+
+	cases := []struct {
+		name      string
+		conflicts int
+		window    time.Duration
+	}{
+		{name: "no conflicts", conflicts: 0, window: base},
+		{name: "one conflict", conflicts: 1, window: 2 * base},
+		{name: "three conflicts", conflicts: 3, window: 8 * base},
+		{name: "capped", conflicts: 5, window: max},
+		{name: "no overflow", conflicts: 100, window: max},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New(context.Background(), "retry")
+			m.RetryInterval, m.MaxRetryInterval = base, max
+			for i := 0; i < tc.conflicts; i++ {
+				m.conflicts = append(m.conflicts, time.Now())
+			}
+
+			for i := 0; i < 50; i++ {
+				d := m.retryDelay()
+				if d < base/2 || d >= base/2+tc.window {
+					t.Fatalf("expected a delay in [%v, %v), got %v", base/2, base/2+tc.window, d)
+				}
+			}
+		})
+	}
+
+	m := New(context.Background(), "retry")
+	m.RetryInterval = base
+	m.lastHolder = &LockInfo{Expires: time.Now().Add(time.Minute)}
+	if d := m.retryDelay(); d < 59*time.Second {
+		t.Errorf("expected to wait for the holder's lease, got %v", d)
+	}
+
+	m.conflicts = []time.Time{time.Now().Add(-2 * m.TTL)}
+	m.lastHolder = nil
+	if d := m.retryDelay(); d >= base/2+base || len(m.conflicts) != 0 {
+		t.Errorf("expected old conflicts to be dropped, got %v and %v", d, m.conflicts)
+	}
+}
+
+func TestErrorReporter(t *testing.T) {
+	throttled := func(id string) error {
+		return awserr.NewRequestFailure(awserr.New("ThrottlingException", "Rate exceeded", nil), 400, id)
+	}
+
+	failed := errors.New("connection refused")
+	steps := []struct {
+		name       string
+		err        error
+		report     bool
+		suppressed int
+	}{
+		{name: "first", err: throttled("1"), report: true},
+		{name: "another request", err: throttled("2"), report: false},
+		{name: "wrapped", err: fmt.Errorf("renew: %w", throttled("3")), report: false},
+		{name: "another code", err: awserr.NewRequestFailure(awserr.New("InternalServerError", "oops", nil), 500, "4"), report: true, suppressed: 2},
+		{name: "plain", err: failed, report: true},
+		{name: "plain again", err: errors.New("connection refused"), report: false},
+		{name: "back to throttled", err: throttled("5"), report: true, suppressed: 1},
+	}
+
+	var r errorReporter
+	for _, s := range steps {
+		ok, suppressed := r.report(s.err, time.Minute)
+		if ok != s.report || suppressed != s.suppressed {
+			t.Errorf("%s: expected %v, %v, got %v, %v", s.name, s.report, s.suppressed, ok, suppressed)
+		}
+	}
+
+	r.last = time.Now().Add(-2 * time.Minute)
+	if ok, _ := r.report(throttled("6"), time.Minute); !ok {
+		t.Errorf("after the interval: expected the error to be reported")
+	}
+}
@@ -0,0 +1,299 @@
+package ddblock
+
+import (
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// maxTransactItems is the most items in one TransactWriteItems call.
+const maxTransactItems = 100
+
+// Session owns many locks and renews them all with one heartbeat, in
+// transactions of up to 100 items, instead of one goroutine and one PutItem
+// per lock. When the session ends, or its process dies, all its locks are
+// released or lapse together. Locks of a session must be in one region.
+type Session struct {
+	// TTL is the lease of every lock of the session.
+	TTL time.Duration
+
+	ctx    context.Context
+	cancel func()
+
+	lk    sync.Mutex
+	locks map[*Mutex]struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewSession creates a session. Its locks are released when the context is
+// canceled or Close is called.
+func NewSession(ctx context.Context) *Session {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Session{
+		TTL:    DefaultTTL,
+		ctx:    ctx,
+		cancel: cancel,
+		locks:  make(map[*Mutex]struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// New creates a mutex owned by the session. It is renewed by the session
+// instead of its own heartbeat, so ManualRenew is set, and uses the
+// session's TTL.
+func (s *Session) New(name string, opts ...Option) *Mutex {
+	m := New(s.ctx, name, opts...)
+	m.ManualRenew = true
+	m.TTL = s.TTL
+	m.session = s
+
+	return m
+}
+
+// Done returns a channel closed when the session has ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close releases all the locks of the session and stops its heartbeat.
+// The first error releasing a lock is returned.
+func (s *Session) Close() error {
+	s.cancel()
+
+	var err error
+	for _, e := range s.snapshot() {
+		if uerr := e.m.Unlock(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+
+	s.lk.Lock()
+	if !closed(s.done) {
+		close(s.done)
+	}
+	s.lk.Unlock()
+
+	return err
+}
+
+// add starts renewing the lock, starting the heartbeat if needed.
+func (s *Session) add(m *Mutex) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.locks[m] = struct{}{}
+	s.once.Do(func() {
+		go pprof.Do(s.ctx, pprof.Labels("ddblock_session", m.TableName), func(context.Context) { s.heartbeat() })
+	})
+}
+
+// remove stops renewing the lock.
+func (s *Session) remove(m *Mutex) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.locks, m)
+}
+
+// sessionLease is a lock being renewed as of the start of a heartbeat.
+type sessionLease struct {
+	m    *Mutex
+	uuid string
+	ttl  time.Duration
+}
+
+func (s *Session) snapshot() []sessionLease {
+	s.lk.Lock()
+	mutexes := make([]*Mutex, 0, len(s.locks))
+	for m := range s.locks {
+		mutexes = append(mutexes, m)
+	}
+	s.lk.Unlock()
+
+	leases := make([]sessionLease, 0, len(mutexes))
+	for _, m := range mutexes {
+		m.lk.Lock()
+		leases = append(leases, sessionLease{m: m, uuid: m.uuid, ttl: m.renewalTTL()})
+		m.lk.Unlock()
+	}
+
+	return leases
+}
+
+func (s *Session) heartbeat() {
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	for {
+		select {
+		case <-time.After(ttl/2 - heartbeatJitter(0, ttl/2)):
+		case <-s.ctx.Done():
+			s.Close()
+			return
+		}
+
+		s.renew()
+	}
+}
+
+// renew extends the leases of all the locks of the session.
+func (s *Session) renew() {
+	now := time.Now()
+
+	var (
+		batch []sessionLease
+		items []*dynamodb.TransactWriteItem
+	)
+	for _, l := range s.snapshot() {
+		put, ok := l.m.renewPut(l.uuid, now.Add(l.ttl))
+		if !ok {
+			// shards, advisory and shadow locks are renewed on their own
+			l.m.update()
+			continue
+		}
+
+		batch = append(batch, l)
+		items = append(items, &dynamodb.TransactWriteItem{Put: put})
+
+		if len(items) == maxTransactItems {
+			s.transact(batch, items, now)
+			batch, items = nil, nil
+		}
+	}
+
+	if len(items) > 0 {
+		s.transact(batch, items, now)
+	}
+}
+
+// transact renews the leases in one transaction. Leases found taken are
+// lost and the others are tried again once. If the transaction fails for
+// another reason the leases are retried on the next heartbeat, or lapse.
+func (s *Session) transact(batch []sessionLease, items []*dynamodb.TransactWriteItem, now time.Time) {
+	for attempt := 0; attempt < 2 && len(items) > 0; attempt++ {
+		_, err := batch[0].m.db().TransactWriteItemsWithContext(s.ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: items,
+		})
+		if err == nil {
+			for _, l := range batch {
+				l.m.sessionRenewed(l.uuid, now, l.ttl)
+			}
+
+			return
+		}
+
+		e, ok := err.(*dynamodb.TransactionCanceledException)
+		if !ok || len(e.CancellationReasons) != len(items) {
+			for _, l := range batch {
+				l.m.sessionFailed(l.uuid, err)
+			}
+
+			return
+		}
+
+		var (
+			retryBatch []sessionLease
+			retryItems []*dynamodb.TransactWriteItem
+		)
+		for i, r := range e.CancellationReasons {
+			switch aws.StringValue(r.Code) {
+			case "ConditionalCheckFailed":
+				batch[i].m.sessionLost(batch[i].uuid)
+			default:
+				// canceled because of another item
+				retryBatch = append(retryBatch, batch[i])
+				retryItems = append(retryItems, items[i])
+			}
+		}
+
+		batch, items = retryBatch, retryItems
+	}
+}
+
+// renewPut returns the put renewing the lease, false if the lock can not
+// be renewed in a transaction.
+func (m *Mutex) renewPut(uuid string, expires time.Time) (*dynamodb.Put, bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid != uuid || m.holdRemaining() <= 0 || m.backend != nil || m.mode == Advisory || m.shadowed || m.Shards > 0 {
+		return nil, false
+	}
+
+	return &dynamodb.Put{
+		TableName:           &m.TableName,
+		Item:                m.item(expires),
+		ConditionExpression: aws.String("#name = :name AND #uuid = :uuid"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String(m.Schema.keyName()),
+			"#uuid": aws.String(m.Schema.uuidName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: &m.fullname,
+			},
+			":uuid": {
+				S: aws.String(uuid),
+			},
+		},
+	}, true
+}
+
+func (m *Mutex) sessionRenewed(uuid string, now time.Time, ttl time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid != uuid || m.renewed.IsZero() {
+		return
+	}
+
+	m.renewed, m.ttl = now, ttl
+	m.armExpiring()
+	m.observe(OpRenew, time.Since(now), nil)
+}
+
+func (m *Mutex) sessionLost(uuid string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid != uuid || m.renewed.IsZero() {
+		return
+	}
+
+	m.observe(OpRenew, 0, ErrLockLost)
+	m.audit(AuditLost, nil)
+	m.loseLease(ErrLockLost)
+}
+
+func (m *Mutex) sessionFailed(uuid string, err error) {
+	m.lk.Lock()
+	remaining := m.remaining()
+	current := m.uuid == uuid && !m.renewed.IsZero()
+	if current {
+		m.observe(OpRenew, 0, err)
+	}
+	m.lk.Unlock()
+
+	if !current {
+		return
+	}
+
+	if remaining <= 0 {
+		m.lapsed(err)
+		return
+	}
+
+	m.reportRenewError(err)
+}
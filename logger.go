@@ -0,0 +1,44 @@
+package ddblock
+
+import (
+	"log/slog"
+)
+
+// Logger receives the notable events of a Mutex, renewal failures, lost
+// leases and takeovers of expired locks, as a message with key value pairs
+// like log/slog. A *slog.Logger can be used directly. It is called while the
+// mutex is locked so must not call its methods.
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// WithLogger sets the logger of the mutex.
+func WithLogger(logger Logger) Option {
+	return func(m *Mutex) {
+		m.Logger = logger
+	}
+}
+
+// DefaultLogger returns the logger of the mutexes, and the other parts of
+// ddblock, without a Logger, the default slog logger.
+func DefaultLogger() Logger {
+	return slog.Default()
+}
+
+// logger returns the Logger, or the DefaultLogger if not set.
+func (m *Mutex) logger() Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+
+	return DefaultLogger()
+}
+
+// logTakeover logs that the expired lease in m.previous was taken over.
+// Must be called with m.lk held.
+func (m *Mutex) logTakeover() {
+	m.logger().Info("ddblock: took over expired lock", "lock", m.name,
+		"previous", m.previous.UUID, "expired", m.previous.Expires)
+}
@@ -0,0 +1,68 @@
+package ddblock
+
+// Done returns a channel that is closed when the current, or next, lease of
+// the mutex ends, whether it was released, lost or lapsed. A new channel is
+// used for every lease.
+func (m *Mutex) Done() <-chan struct{} {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.leaseChannels()
+	return m.done
+}
+
+// Lost returns a channel that is closed if the current, or next, lease of
+// the mutex is lost, because someone else took the lock or renewals failed
+// until it lapsed, but not when it is released. The application should
+// stop its critical work gracefully, Err returns the reason.
+func (m *Mutex) Lost() <-chan struct{} {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.leaseChannels()
+	return m.lost
+}
+
+// Err returns why the last lease was lost, ErrLockLost if someone else took
+// the lock or the last renewal error if it lapsed. It is nil otherwise.
+func (m *Mutex) Err() error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.lostErr
+}
+
+// leaseChannels creates the channels for the next lease if the
+// previous one has ended. Must be called with m.lk held.
+func (m *Mutex) leaseChannels() {
+	if m.done != nil && !closed(m.done) {
+		return
+	}
+
+	m.done = make(chan struct{})
+	m.lost = make(chan struct{})
+}
+
+// loseLease forgets the lease, signaling Lost. Must be called with m.lk held.
+func (m *Mutex) loseLease(err error) {
+	m.logger().Error("ddblock: lock lost", "lock", m.name, "uuid", m.uuid, "error", err)
+
+	m.leaseChannels()
+	m.lostErr = err
+	close(m.lost)
+
+	if onLost := m.Lifecycle.OnLost; onLost != nil {
+		m.notify(func() { onLost(err) })
+	}
+
+	m.clearLease()
+}
+
+func closed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,111 @@
+// Package memory is an in-process ddblock.Backend, for unit tests of code
+// that uses ddblock without AWS credentials or a network:
+//
+//	b := memory.New()
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(b))
+//
+// Mutexes sharing a Backend contend for the same locks, with the same
+// conditional semantics as the DynamoDB table.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// Backend stores leases in a map. The zero value is not usable, see New.
+type Backend struct {
+	lk     sync.Mutex
+	leases map[string]ddblock.LockInfo
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates an empty backend.
+func New() *Backend {
+	return &Backend{
+		leases: make(map[string]ddblock.LockInfo),
+	}
+}
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	var previous *ddblock.LockInfo
+	if current, ok := b.leases[lease.Name]; ok && current.UUID != lease.UUID {
+		if !current.Expires.Before(cutoff) {
+			return nil, ddblock.ErrConflict
+		}
+
+		previous = &current
+	}
+
+	b.leases[lease.Name] = *lease
+	return previous, nil
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if current, ok := b.leases[lease.Name]; !ok || current.UUID != lease.UUID {
+		return ddblock.ErrConflict
+	}
+
+	b.leases[lease.Name] = *lease
+	return nil
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if current, ok := b.leases[name]; !ok || current.UUID != uuid {
+		return ddblock.ErrConflict
+	}
+
+	delete(b.leases, name)
+	return nil
+}
+
+// Get returns a copy of the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	current, ok := b.leases[name]
+	if !ok {
+		return nil, nil
+	}
+
+	return &current, nil
+}
+
+// Expire makes the lease of the named lock lapse now, as if the holder
+// had stopped renewing, so tests can exercise takeovers without waiting.
+func (b *Backend) Expire(name string) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if current, ok := b.leases[name]; ok {
+		current.Expires = time.Now().Add(-time.Nanosecond)
+		b.leases[name] = current
+	}
+}
+
+// Clear removes all the leases.
+func (b *Backend) Clear() {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	b.leases = make(map[string]ddblock.LockInfo)
+}
@@ -0,0 +1,117 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulmach/ddblock"
+	"github.com/paulmach/ddblock/conformance"
+	"github.com/paulmach/ddblock/memory"
+
+	"golang.org/x/net/context"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() ddblock.Backend {
+		return memory.New()
+	})
+}
+
+func TestMutexConflict(t *testing.T) {
+	ctx := context.Background()
+	b := memory.New()
+
+	m1 := ddblock.New(ctx, "conflict", ddblock.WithBackend(b))
+	m2 := ddblock.New(ctx, "conflict", ddblock.WithBackend(b))
+
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	defer m1.Unlock()
+
+	if err := m2.TryLock(); !ddblock.IsAquireError(err) {
+		t.Errorf("lock of a held lock: expected a conflict, got %v", err)
+	}
+}
+
+func TestMutexExpiry(t *testing.T) {
+	ctx := context.Background()
+	b := memory.New()
+
+	m1 := ddblock.New(ctx, "expiry", ddblock.WithBackend(b))
+	m1.ManualRenew = true
+	m2 := ddblock.New(ctx, "expiry", ddblock.WithBackend(b))
+
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	b.Expire(m1.ItemName())
+
+	if err := m2.TryLock(); err != nil {
+		t.Fatalf("lock of an expired lock: %v", err)
+	}
+	defer m2.Unlock()
+
+	if p := m2.Previous(); p == nil || p.UUID != m1.Token() {
+		t.Errorf("previous: expected the lease of m1, got %v", p)
+	}
+}
+
+func TestMutexUnlock(t *testing.T) {
+	ctx := context.Background()
+	b := memory.New()
+
+	m1 := ddblock.New(ctx, "unlock", ddblock.WithBackend(b))
+	m2 := ddblock.New(ctx, "unlock", ddblock.WithBackend(b))
+
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := m1.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	if info, err := b.Get(ctx, m1.ItemName()); err != nil || info != nil {
+		t.Errorf("get after unlock: expected no lease, got %v, %v", info, err)
+	}
+
+	if err := m2.TryLock(); err != nil {
+		t.Fatalf("lock of an unlocked lock: %v", err)
+	}
+
+	if err := m2.Unlock(); err != nil {
+		t.Errorf("unlock: %v", err)
+	}
+}
+
+func TestMutexLost(t *testing.T) {
+	ctx := context.Background()
+	b := memory.New()
+	ttl := 300 * time.Millisecond
+
+	m1 := ddblock.New(ctx, "lost", ddblock.WithBackend(b), ddblock.WithTTL(ttl))
+	m2 := ddblock.New(ctx, "lost", ddblock.WithBackend(b), ddblock.WithTTL(ttl))
+
+	if err := m1.TryLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	// someone else takes the lock, the next renewal of m1 fails
+	b.Expire(m1.ItemName())
+	if err := m2.TryLock(); err != nil {
+		t.Fatalf("lock of an expired lock: %v", err)
+	}
+	defer m2.Unlock()
+
+	select {
+	case <-m1.Lost():
+	case <-time.After(5 * ttl):
+		t.Fatalf("lost: not signaled")
+	}
+
+	if err := m1.Err(); err != ddblock.ErrLockLost {
+		t.Errorf("err: expected %v, got %v", ddblock.ErrLockLost, err)
+	}
+}
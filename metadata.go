@@ -0,0 +1,30 @@
+package ddblock
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var metadataString = "metadata"
+
+// metadataAttribute encodes the metadata as a map attribute of strings.
+func metadataAttribute(md map[string]string) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(md))
+	for k, v := range md {
+		m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+
+	return &dynamodb.AttributeValue{M: m}
+}
+
+// metadataFromAttribute decodes the metadata, ignoring values that are not strings.
+func metadataFromAttribute(av *dynamodb.AttributeValue) map[string]string {
+	md := make(map[string]string, len(av.M))
+	for k, v := range av.M {
+		if v.S != nil {
+			md[k] = *v.S
+		}
+	}
+
+	return md
+}
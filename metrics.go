@@ -0,0 +1,67 @@
+package ddblock
+
+import (
+	"time"
+)
+
+// Metrics receives counts and latencies of the operations of a Mutex, for
+// example to export them to Prometheus or CloudWatch. Unlike Trace it is not
+// sampled. It is called while the mutex is locked so must be fast and must
+// not call its methods.
+type Metrics interface {
+	// Acquired is called when the lock is taken.
+	Acquired(name string)
+
+	// Conflict is called when acquiring finds the lock held by another.
+	Conflict(name string)
+
+	// Renewed is called when the lease is extended.
+	Renewed(name string)
+
+	// RenewFailed is called when extending the lease fails, including
+	// when it is found taken by another.
+	RenewFailed(name string, err error)
+
+	// Released is called when the lock is released, with how long it was held.
+	Released(name string, held time.Duration)
+
+	// Latency is called after each operation, successful or not.
+	Latency(name string, op Op, d time.Duration, err error)
+}
+
+// WithMetrics sets the metrics of the mutex.
+func WithMetrics(metrics Metrics) Option {
+	return func(m *Mutex) {
+		m.Metrics = metrics
+	}
+}
+
+// observe reports the operation to the Metrics and the Lifecycle callbacks.
+// Must be called with m.lk held.
+func (m *Mutex) observe(op Op, d time.Duration, err error) {
+	m.lifecycle(op, err)
+
+	if m.Metrics == nil {
+		return
+	}
+
+	m.Metrics.Latency(m.name, op, d, err)
+
+	switch {
+	case op == OpAcquire && err == nil:
+		m.Metrics.Acquired(m.name)
+	case op == OpAcquire && IsAquireError(err):
+		m.Metrics.Conflict(m.name)
+	case op == OpRenew && err == nil:
+		m.Metrics.Renewed(m.name)
+	case op == OpRenew:
+		m.Metrics.RenewFailed(m.name, err)
+	case op == OpRelease && err == nil:
+		var held time.Duration
+		if !m.acquired.IsZero() {
+			held = time.Since(m.acquired)
+		}
+
+		m.Metrics.Released(m.name, held)
+	}
+}
@@ -0,0 +1,96 @@
+package ddblock
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MultiLock holds several mutexes, possibly in different tables, taking
+// them one by one in a canonical order, by table and item name, so two
+// workflows locking overlapping sets can not deadlock. If a lock can not be
+// taken the ones already held are unlocked. Unlike AcquireAll it is not
+// atomic, others may see some of the locks held for a moment, but it is
+// not limited to the locks that fit in one transaction.
+type MultiLock struct {
+	mutexes []*Mutex
+}
+
+// NewMultiLock creates a lock of all the mutexes.
+func NewMultiLock(mutexes ...*Mutex) *MultiLock {
+	ms := append([]*Mutex(nil), mutexes...)
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].TableName != ms[j].TableName {
+			return ms[i].TableName < ms[j].TableName
+		}
+
+		return ms[i].fullname < ms[j].fullname
+	})
+
+	return &MultiLock{mutexes: ms}
+}
+
+// NewMultiLock creates a lock of the named locks of the client.
+func (c *Client) NewMultiLock(ctx context.Context, names ...string) *MultiLock {
+	ms := make([]*Mutex, len(names))
+	for i, name := range names {
+		ms[i] = c.New(ctx, name)
+	}
+
+	return NewMultiLock(ms...)
+}
+
+// Mutexes returns the mutexes in the order they are locked.
+func (l *MultiLock) Mutexes() []*Mutex {
+	return l.mutexes
+}
+
+// TryLock takes every lock without waiting. If one is held by someone
+// else, or can not be taken, the locks already taken are unlocked and
+// its error is returned.
+func (l *MultiLock) TryLock() error {
+	for i, m := range l.mutexes {
+		if err := m.TryLock(); err != nil {
+			l.rollback(i)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LockWait takes every lock in order, waiting for each to be released,
+// until the context is done. The locks already taken are unlocked on
+// failure. It returns how long it waited in total.
+func (l *MultiLock) LockWait(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	for i, m := range l.mutexes {
+		if _, err := m.LockWait(ctx); err != nil {
+			l.rollback(i)
+			return time.Since(start), err
+		}
+	}
+
+	return time.Since(start), nil
+}
+
+// Unlock releases every lock, in the reverse order, and
+// returns the first error.
+func (l *MultiLock) Unlock() error {
+	var first error
+	for i := len(l.mutexes) - 1; i >= 0; i-- {
+		if err := l.mutexes[i].Unlock(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// rollback unlocks the first n mutexes, which were taken, in reverse order.
+func (l *MultiLock) rollback(n int) {
+	for i := n - 1; i >= 0; i-- {
+		l.mutexes[i].Unlock()
+	}
+}
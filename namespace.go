@@ -0,0 +1,21 @@
+package ddblock
+
+// NamespaceSeparator separates the namespace from the lock name
+// in the name of the lock item.
+var NamespaceSeparator = "/"
+
+// Namespace returns a client for the locks of the namespace, for example an
+// environment or tenant, so several can share a table without their lock
+// names colliding. The names of the lock items are prefixed with the
+// namespace and the NamespaceSeparator, after the client's prefix.
+// If the namespace is in NamespaceTables its locks are stored in that
+// table instead, isolating it completely. Namespaces can be nested.
+func (c *Client) Namespace(namespace string) *Client {
+	n := *c
+	n.Prefix = c.Prefix + namespace + NamespaceSeparator
+	if table := c.NamespaceTables[namespace]; table != "" {
+		n.TableName = table
+	}
+
+	return &n
+}
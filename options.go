@@ -0,0 +1,109 @@
+package ddblock
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+// Option configures a Mutex in New. Options are applied before the mutex
+// is used, unlike setting its fields later, which can race with the
+// background renewal.
+type Option func(*Mutex)
+
+// WithTableName sets the table of the lock item.
+func WithTableName(name string) Option {
+	return func(m *Mutex) {
+		m.TableName = name
+	}
+}
+
+// WithTTL sets the lease duration.
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Mutex) {
+		m.TTL = ttl
+	}
+}
+
+// WithClient sets the dynamodb client used for the lock item
+// instead of the default client.
+func WithClient(client dynamodbiface.DynamoDBAPI) Option {
+	return func(m *Mutex) {
+		m.svc = client
+	}
+}
+
+// WithOneShot holds the lock for one TTL without renewing it, see OneShot.
+func WithOneShot() Option {
+	return func(m *Mutex) {
+		m.OneShot = true
+	}
+}
+
+// WithOwner sets the caller supplied owner recorded on the lock item,
+// see OwnerName.
+func WithOwner(name string) Option {
+	return func(m *Mutex) {
+		m.OwnerName = name
+	}
+}
+
+// WithMetadata sets the caller defined attributes stored on the lock item,
+// see Metadata.
+func WithMetadata(md map[string]string) Option {
+	return func(m *Mutex) {
+		m.Metadata = md
+	}
+}
+
+// WithHeartbeatInterval sets how often the lease is renewed.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(m *Mutex) {
+		m.HeartbeatInterval = interval
+	}
+}
+
+// WithSchema sets the names of the lock item attributes, to share a table
+// whose key has a different name.
+func WithSchema(schema *Schema) Option {
+	return func(m *Mutex) {
+		m.Schema = schema
+	}
+}
+
+// WithPrefix sets the prefix of the lock item name instead of DefaultPrefix.
+// It may be empty so the item is named after the lock, to match the naming
+// of other tools. Every user of the lock must agree on the prefix.
+func WithPrefix(prefix string) Option {
+	return func(m *Mutex) {
+		m.fullname = prefix + m.name
+	}
+}
+
+// WithStreamsClient sets the dynamodb streams client used with WaitOnStream
+// instead of the default client. It must be for the same region as the
+// dynamodb client.
+func WithStreamsClient(client dynamodbstreamsiface.DynamoDBStreamsAPI) Option {
+	return func(m *Mutex) {
+		m.streams = client
+	}
+}
+
+// db returns the dynamodb client of the mutex.
+func (m *Mutex) db() dynamodbiface.DynamoDBAPI {
+	if m.svc != nil {
+		return m.svc
+	}
+
+	return getSvc()
+}
+
+// streamsDB returns the dynamodb streams client of the mutex.
+func (m *Mutex) streamsDB() dynamodbstreamsiface.DynamoDBStreamsAPI {
+	if m.streams != nil {
+		return m.streams
+	}
+
+	return getStreamSvc()
+}
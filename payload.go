@@ -0,0 +1,218 @@
+package ddblock
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+var payloadString = "payload"
+
+// Codec encodes the payload stored on a lock item.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes payloads as JSON. See the protocodec
+// package for protocol buffers.
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// payloadAttribute stores the payload as a string, so it is readable in the
+// console, if the encoding is valid UTF-8 and as binary otherwise.
+func payloadAttribute(data []byte) *dynamodb.AttributeValue {
+	if utf8.Valid(data) {
+		s := string(data)
+		return &dynamodb.AttributeValue{S: &s}
+	}
+
+	return &dynamodb.AttributeValue{B: data}
+}
+
+func payloadFromAttribute(av *dynamodb.AttributeValue) []byte {
+	if av.S != nil {
+		return []byte(*av.S)
+	}
+
+	return av.B
+}
+
+// SetPayload encodes v as JSON and stores it as the payload of the lock item,
+// to publish structured state such as the leader's endpoint. If the lock is
+// held the item is updated right away, renewing the lease, otherwise the
+// payload is written when the lock is acquired.
+func (m *Mutex) SetPayload(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return m.publishPayload(data)
+}
+
+// publishPayload stores the encoded payload, updating the lock item if held.
+func (m *Mutex) publishPayload(data []byte) error {
+	m.lk.Lock()
+	m.payload = data
+	m.lk.Unlock()
+
+	if err := m.update(); err != nil && err != ErrNotHeld {
+		return err
+	}
+
+	return nil
+}
+
+// GetPayload decodes the JSON payload of this lock into v, which is left
+// unchanged if there is no payload. See DecodePayload for the payload of
+// another holder.
+func (m *Mutex) GetPayload(v interface{}) error {
+	m.lk.Lock()
+	data := m.payload
+	m.lk.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// TypedLock is a Mutex whose lock item carries a payload of type T,
+// encoded with the codec, for example the job parameters of the holder.
+type TypedLock[T any] struct {
+	*Mutex
+	Codec Codec
+}
+
+// NewTyped creates a new typed lock. The codec defaults to JSONCodec.
+func NewTyped[T any](ctx context.Context, name string, codec Codec, opts ...Option) *TypedLock[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return &TypedLock[T]{
+		Mutex: New(ctx, name, opts...),
+		Codec: codec,
+	}
+}
+
+// Lock is like Mutex.Lock storing v as the payload of the lock item.
+func (l *TypedLock[T]) Lock(v T) error {
+	if err := l.setPayload(v); err != nil {
+		return err
+	}
+
+	return l.Mutex.Lock()
+}
+
+// TryLock is like Mutex.TryLock storing v as the payload of the lock item.
+func (l *TypedLock[T]) TryLock(v T) error {
+	if err := l.setPayload(v); err != nil {
+		return err
+	}
+
+	return l.Mutex.TryLock()
+}
+
+// LockWait is like Mutex.LockWait storing v as the payload of the lock item.
+func (l *TypedLock[T]) LockWait(ctx context.Context, v T) (time.Duration, error) {
+	if err := l.setPayload(v); err != nil {
+		return 0, err
+	}
+
+	return l.Mutex.LockWait(ctx)
+}
+
+// Acquire is LockWait storing v as the payload of the lock item, returning
+// the payload of the previous holder if its lease had expired and was taken
+// over, the zero value otherwise.
+func (l *TypedLock[T]) Acquire(ctx context.Context, v T) (T, error) {
+	if _, err := l.LockWait(ctx, v); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return l.PreviousPayload()
+}
+
+// PreviousPayload returns the payload of the previous holder, if its lease
+// had expired when this lock was acquired, the zero value otherwise.
+func (l *TypedLock[T]) PreviousPayload() (T, error) {
+	previous := l.Previous()
+	if previous == nil {
+		var zero T
+		return zero, nil
+	}
+
+	return decodePayload[T](previous.Payload, l.Codec)
+}
+
+// SetPayload replaces the payload of the lock item with v. If the lock is
+// held the item is updated right away, renewing the lease, otherwise the
+// payload is written when the lock is acquired.
+func (l *TypedLock[T]) SetPayload(v T) error {
+	data, err := l.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return l.publishPayload(data)
+}
+
+// Payload returns the payload of this lock.
+func (l *TypedLock[T]) Payload() (T, error) {
+	l.lk.Lock()
+	data := l.payload
+	l.lk.Unlock()
+
+	return decodePayload[T](data, l.Codec)
+}
+
+func (l *TypedLock[T]) setPayload(v T) error {
+	data, err := l.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	l.lk.Lock()
+	l.payload = data
+	l.lk.Unlock()
+
+	return nil
+}
+
+// DecodePayload decodes the payload of a lock item, for example
+// from Inspector.GetLockInfo, using the codec, JSONCodec if nil.
+// The zero value is returned if the item has no payload.
+func DecodePayload[T any](info *LockInfo, codec Codec) (T, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return decodePayload[T](info.Payload, codec)
+}
+
+func decodePayload[T any](data []byte, codec Codec) (T, error) {
+	var v T
+	if len(data) == 0 {
+		return v, nil
+	}
+
+	err := codec.Unmarshal(data, &v)
+	return v, err
+}
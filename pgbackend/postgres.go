@@ -0,0 +1,209 @@
+// Package pgbackend stores ddblock locks in a Postgres table, for deployments
+// where DynamoDB is not available:
+//
+//	db, err := sql.Open("pgx", dsn)
+//	b := pgbackend.New(db)
+//	err = b.EnsureTable(ctx)
+//
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(b))
+//
+// Each lock is a row, taken and renewed with conditional inserts and
+// updates, so it works with connection poolers unlike session level
+// advisory locks. Import the driver of your choice.
+package pgbackend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultTable is the table of the locks.
+var DefaultTable = "ddblock_locks"
+
+// Backend is a ddblock.Backend storing locks in Postgres.
+type Backend struct {
+	DB *sql.DB
+
+	// Table defaults to DefaultTable. It is not quoted.
+	Table string
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates a backend using the database.
+func New(db *sql.DB) *Backend {
+	return &Backend{
+		DB: db,
+	}
+}
+
+func (b *Backend) table() string {
+	if b.Table == "" {
+		return DefaultTable
+	}
+
+	return b.Table
+}
+
+// EnsureTable creates the table of the locks if it does not exist.
+func (b *Backend) EnsureTable(ctx context.Context) error {
+	_, err := b.DB.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name    text PRIMARY KEY,
+	uuid    text NOT NULL,
+	expires timestamptz NOT NULL,
+	lease   jsonb NOT NULL
+)`, b.table()))
+	return err
+}
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	// the row may be deleted between the insert and the select,
+	// then try again
+	for attempt := 0; attempt < 3; attempt++ {
+		previous, ok, err := b.put(ctx, lease, data, cutoff)
+		if err != nil || ok {
+			return previous, err
+		}
+	}
+
+	return nil, ddblock.ErrConflict
+}
+
+// put returns false if the row was deleted concurrently.
+func (b *Backend) put(ctx context.Context, lease *ddblock.LockInfo, data []byte, cutoff time.Time) (*ddblock.LockInfo, bool, error) {
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (name, uuid, expires, lease)
+VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO NOTHING`, b.table()),
+		lease.Name, lease.UUID, lease.Expires, string(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 1 {
+		return nil, true, tx.Commit()
+	}
+
+	current, err := scan(tx.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT uuid, expires, lease FROM %s WHERE name = $1 FOR UPDATE`, b.table()), lease.Name))
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if current.UUID != lease.UUID && !current.Expires.Before(cutoff) {
+		return nil, true, ddblock.ErrConflict
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		`UPDATE %s SET uuid = $2, expires = $3, lease = $4 WHERE name = $1`, b.table()),
+		lease.Name, lease.UUID, lease.Expires, string(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	if current.UUID == lease.UUID {
+		return nil, true, nil
+	}
+
+	return current, true, nil
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	res, err := b.DB.ExecContext(ctx, fmt.Sprintf(
+		`UPDATE %s SET expires = $3, lease = $4 WHERE name = $1 AND uuid = $2`, b.table()),
+		lease.Name, lease.UUID, lease.Expires, string(data))
+	if err != nil {
+		return err
+	}
+
+	return conflict(res)
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	res, err := b.DB.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE name = $1 AND uuid = $2`, b.table()), name, uuid)
+	if err != nil {
+		return err
+	}
+
+	return conflict(res)
+}
+
+// Get returns the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	lease, err := scan(b.DB.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT uuid, expires, lease FROM %s WHERE name = $1`, b.table()), name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return lease, err
+}
+
+// conflict returns ErrConflict if no row was changed.
+func conflict(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ddblock.ErrConflict
+	}
+
+	return nil
+}
+
+func scan(row *sql.Row) (*ddblock.LockInfo, error) {
+	var (
+		uuid    string
+		expires time.Time
+		data    []byte
+	)
+	if err := row.Scan(&uuid, &expires, &data); err != nil {
+		return nil, err
+	}
+
+	lease := &ddblock.LockInfo{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+
+	// the columns are used in the conditions, so they are authoritative
+	lease.UUID, lease.Expires = uuid, expires
+	return lease, nil
+}
@@ -0,0 +1,175 @@
+package ddblock
+
+import (
+	"encoding/json"
+)
+
+// PolicyConfig describes the lock table and the features in use,
+// for generating the least privilege IAM policy with IAMPolicy.
+type PolicyConfig struct {
+	// Partition, Region and AccountID build the table arn.
+	// Partition defaults to "aws", the others to "*".
+	Partition string
+	Region    string
+	AccountID string
+
+	// TableName defaults to DefaultTableName.
+	TableName string
+
+	// IndexName, if set, grants querying the index.
+	IndexName string
+
+	// Prefix, if set, restricts item access to lock items starting with it,
+	// for example DefaultPrefix.
+	Prefix string
+
+	// ReadOnly grants only what an Inspector needs, reading and
+	// scanning items, instead of what is needed to take locks.
+	ReadOnly bool
+
+	// Shards grants the batch writes used to update shard items.
+	Shards bool
+
+	// Updates grants the item updates used by Advisory mode,
+	// Semaphore and Sequencer.
+	Updates bool
+
+	// Transactions grants the condition checks of HolderCheck
+	// and TransactWrite.
+	Transactions bool
+
+	// Streams grants reading the table's stream, for WaitOnStream.
+	Streams bool
+
+	// CreateTable grants creating and configuring the table. It is only needed
+	// by whatever creates the table, not by the processes taking locks.
+	CreateTable bool
+}
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                         `json:"Sid"`
+	Effect    string                         `json:"Effect"`
+	Action    []string                       `json:"Action"`
+	Resource  []string                       `json:"Resource"`
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
+
+// IAMPolicy returns the least privilege IAM policy document, as JSON,
+// needed to use locks in the configured table.
+func IAMPolicy(cfg PolicyConfig) ([]byte, error) {
+	partition := cfg.Partition
+	if partition == "" {
+		partition = "aws"
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "*"
+	}
+
+	account := cfg.AccountID
+	if account == "" {
+		account = "*"
+	}
+
+	table := cfg.TableName
+	if table == "" {
+		table = DefaultTableName
+	}
+
+	arn := "arn:" + partition + ":dynamodb:" + region + ":" + account + ":table/" + table
+
+	items := policyStatement{
+		Sid:    "LockItems",
+		Effect: "Allow",
+		Action: []string{
+			"dynamodb:GetItem",
+			"dynamodb:PutItem",
+			"dynamodb:DeleteItem",
+		},
+		Resource: []string{arn},
+	}
+
+	if cfg.ReadOnly {
+		items.Action = []string{
+			"dynamodb:GetItem",
+			"dynamodb:Scan",
+		}
+	} else {
+		if cfg.Shards {
+			items.Action = append(items.Action, "dynamodb:BatchWriteItem")
+		}
+
+		if cfg.Updates {
+			items.Action = append(items.Action, "dynamodb:UpdateItem")
+		}
+
+		if cfg.Transactions {
+			items.Action = append(items.Action, "dynamodb:ConditionCheckItem")
+		}
+	}
+
+	if cfg.Prefix != "" {
+		items.Condition = map[string]map[string][]string{
+			"ForAllValues:StringLike": {
+				"dynamodb:LeadingKeys": {cfg.Prefix + "*"},
+			},
+		}
+	}
+
+	doc := policyDocument{
+		Version:   "2012-10-17",
+		Statement: []policyStatement{items},
+	}
+
+	if cfg.IndexName != "" {
+		doc.Statement = append(doc.Statement, policyStatement{
+			Sid:      "LockIndex",
+			Effect:   "Allow",
+			Action:   []string{"dynamodb:Query"},
+			Resource: []string{arn + "/index/" + cfg.IndexName},
+		})
+	}
+
+	if cfg.Streams {
+		doc.Statement = append(doc.Statement,
+			policyStatement{
+				Sid:      "LockTableStream",
+				Effect:   "Allow",
+				Action:   []string{"dynamodb:DescribeTable"},
+				Resource: []string{arn},
+			},
+			policyStatement{
+				Sid:    "LockStream",
+				Effect: "Allow",
+				Action: []string{
+					"dynamodb:DescribeStream",
+					"dynamodb:GetShardIterator",
+					"dynamodb:GetRecords",
+				},
+				Resource: []string{arn + "/stream/*"},
+			},
+		)
+	}
+
+	if cfg.CreateTable {
+		doc.Statement = append(doc.Statement, policyStatement{
+			Sid:    "LockTableAdmin",
+			Effect: "Allow",
+			Action: []string{
+				"dynamodb:CreateTable",
+				"dynamodb:DescribeTable",
+				"dynamodb:DescribeTimeToLive",
+				"dynamodb:UpdateTimeToLive",
+			},
+			Resource: []string{arn},
+		})
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
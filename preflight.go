@@ -0,0 +1,239 @@
+package ddblock
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	"golang.org/x/net/context"
+)
+
+// PreflightError is returned by Preflight when some of the
+// permissions needed by the mutex are missing.
+type PreflightError struct {
+	// Missing are the denied IAM actions, like "dynamodb:PutItem".
+	Missing []string
+}
+
+func (e *PreflightError) Error() string {
+	return "ddbmutex: missing permissions: " + strings.Join(e.Missing, ", ")
+}
+
+// preflightCheck calls an operation needing the IAM action.
+type preflightCheck struct {
+	action string
+	call   func() error
+}
+
+// impossibleCondition can never be true so writes using it are
+// authorized, and then fail the condition check, without changing anything.
+const impossibleCondition = "attribute_exists(#name) AND attribute_not_exists(#name)"
+
+// preflightNames are the attribute names of the update checks.
+func preflightNames(schema *Schema) map[string]*string {
+	return map[string]*string{
+		"#name":      aws.String(schema.keyName()),
+		"#preflight": aws.String("preflight"),
+	}
+}
+
+// getCheck checks reading the item.
+func getCheck(ctx context.Context, db dynamodbiface.DynamoDBAPI, table string, key map[string]*dynamodb.AttributeValue) preflightCheck {
+	return preflightCheck{"dynamodb:GetItem", func() error {
+		_, err := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: &table,
+			Key:       key,
+		})
+		return err
+	}}
+}
+
+// updateCheck checks updating the item, as Advisory mode,
+// Semaphore and Sequencer do.
+func updateCheck(ctx context.Context, db dynamodbiface.DynamoDBAPI, table string, key map[string]*dynamodb.AttributeValue, schema *Schema) preflightCheck {
+	return preflightCheck{"dynamodb:UpdateItem", func() error {
+		_, err := db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:                &table,
+			Key:                      key,
+			UpdateExpression:         aws.String("REMOVE #preflight"),
+			ConditionExpression:      aws.String(impossibleCondition),
+			ExpressionAttributeNames: preflightNames(schema),
+		})
+		return err
+	}}
+}
+
+// Preflight checks the mutex has the permissions it needs by exercising
+// each operation in a way that does not change anything, so missing
+// permissions are found at startup instead of inside a renewal. A
+// *PreflightError lists the missing permissions. Other errors, like a
+// missing table, are returned as is.
+func (m *Mutex) Preflight(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	key := m.Schema.key(m.fullname)
+	names := map[string]*string{
+		"#name": aws.String(m.Schema.keyName()),
+	}
+
+	checks := []preflightCheck{
+		getCheck(ctx, m.db(), m.TableName, key),
+		{"dynamodb:PutItem", func() error {
+			_, err := m.db().PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				TableName:                &m.TableName,
+				Item:                     key,
+				ConditionExpression:      aws.String(impossibleCondition),
+				ExpressionAttributeNames: names,
+			})
+			return err
+		}},
+		{"dynamodb:DeleteItem", func() error {
+			_, err := m.db().DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+				TableName:                &m.TableName,
+				Key:                      key,
+				ConditionExpression:      aws.String(impossibleCondition),
+				ExpressionAttributeNames: names,
+			})
+			return err
+		}},
+	}
+
+	if m.Mode == Advisory {
+		checks = append(checks, updateCheck(ctx, m.db(), m.TableName, m.advisoryKey(), m.Schema))
+	}
+
+	if m.Shards > 0 {
+		checks = append(checks, preflightCheck{"dynamodb:BatchWriteItem", func() error {
+			// deleting an item that does not exist changes nothing
+			_, err := m.db().BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{
+					m.TableName: {{
+						DeleteRequest: &dynamodb.DeleteRequest{
+							Key: m.Schema.key(m.fullname + "#preflight"),
+						},
+					}},
+				},
+			})
+			return err
+		}})
+	}
+
+	var arn string
+	if m.WaitOnStream {
+		checks = append(checks,
+			preflightCheck{"dynamodb:DescribeTable", func() error {
+				resp, err := m.db().DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+					TableName: &m.TableName,
+				})
+				if err == nil {
+					arn = aws.StringValue(resp.Table.LatestStreamArn)
+				}
+				return err
+			}},
+			preflightCheck{"dynamodb:DescribeStream", func() error {
+				if arn == "" {
+					// not known, checking DescribeTable failed or there is no stream.
+					return nil
+				}
+
+				_, err := m.streamsDB().DescribeStreamWithContext(ctx, &dynamodbstreams.DescribeStreamInput{
+					StreamArn: &arn,
+					Limit:     aws.Int64(1),
+				})
+				return err
+			}},
+		)
+	}
+
+	return runPreflight(checks)
+}
+
+// PreflightTransactions is like Preflight for the permission HolderCheck
+// and TransactWrite need in addition, checking the lock item in the
+// caller's transactions.
+func (m *Mutex) PreflightTransactions(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return runPreflight([]preflightCheck{
+		{"dynamodb:ConditionCheckItem", func() error {
+			_, err := m.db().TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+				TransactItems: []*dynamodb.TransactWriteItem{{
+					ConditionCheck: &dynamodb.ConditionCheck{
+						TableName:           &m.TableName,
+						Key:                 m.Schema.key(m.fullname),
+						ConditionExpression: aws.String(impossibleCondition),
+						ExpressionAttributeNames: map[string]*string{
+							"#name": aws.String(m.Schema.keyName()),
+						},
+					},
+				}},
+			})
+
+			if e, ok := err.(awserr.Error); ok && e.Code() == dynamodb.ErrCodeTransactionCanceledException {
+				// authorized, and canceled by the condition
+				return nil
+			}
+
+			return err
+		}},
+	})
+}
+
+// Preflight checks the semaphore has the permissions it needs,
+// see Mutex.Preflight.
+func (s *Semaphore) Preflight(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return runPreflight([]preflightCheck{
+		getCheck(ctx, s.db(), s.TableName, s.key()),
+		updateCheck(ctx, s.db(), s.TableName, s.key(), s.Schema),
+	})
+}
+
+// Preflight checks the sequencer has the permissions it needs,
+// see Mutex.Preflight.
+func (s *Sequencer) Preflight(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return runPreflight([]preflightCheck{
+		getCheck(ctx, s.db(), s.TableName, s.key("#serving")),
+		updateCheck(ctx, s.db(), s.TableName, s.key("#serving"), s.Schema),
+	})
+}
+
+// runPreflight runs the checks, returning a *PreflightError
+// with the denied actions, if any.
+func runPreflight(checks []preflightCheck) error {
+	var missing []string
+	for _, c := range checks {
+		err := c.call()
+		if err == nil || IsAquireError(err) {
+			continue
+		}
+
+		if e, ok := err.(awserr.Error); ok && e.Code() == "AccessDeniedException" {
+			missing = append(missing, c.action)
+			continue
+		}
+
+		return err
+	}
+
+	if len(missing) > 0 {
+		return &PreflightError{Missing: missing}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package prometheus exports the metrics of ddblock mutexes to Prometheus:
+//
+//	metrics := prometheus.New(prom.DefaultRegisterer)
+//	m := ddblock.New(ctx, "name", ddblock.WithMetrics(metrics))
+//
+// The metrics are labeled with the lock name, so use it with a bounded
+// number of lock names.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/paulmach/ddblock"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a ddblock.Metrics recording to Prometheus collectors.
+// One value can be shared by all mutexes.
+type Metrics struct {
+	acquisitions  *prom.CounterVec
+	conflicts     *prom.CounterVec
+	renewals      *prom.CounterVec
+	renewFailures *prom.CounterVec
+	releases      *prom.CounterVec
+	hold          *prom.HistogramVec
+	latency       *prom.HistogramVec
+}
+
+var _ ddblock.Metrics = &Metrics{}
+
+// New creates the collectors and registers them with the registerer,
+// it panics if they are already registered.
+func New(reg prom.Registerer) *Metrics {
+	counter := func(name, help string) *prom.CounterVec {
+		return prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "ddblock",
+			Name:      name,
+			Help:      help,
+		}, []string{"lock"})
+	}
+
+	m := &Metrics{
+		acquisitions:  counter("acquisitions_total", "Number of times the lock was acquired."),
+		conflicts:     counter("conflicts_total", "Number of acquisitions that found the lock held by another."),
+		renewals:      counter("renewals_total", "Number of lease renewals."),
+		renewFailures: counter("renew_failures_total", "Number of failed lease renewals, including lost leases."),
+		releases:      counter("releases_total", "Number of times the lock was released."),
+		hold: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "ddblock",
+			Name:      "lock_hold_seconds",
+			Help:      "How long the lock was held until released.",
+			Buckets:   prom.ExponentialBuckets(0.1, 4, 10),
+		}, []string{"lock"}),
+		latency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "ddblock",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of the operations on the lock items.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"lock", "op", "outcome"}),
+	}
+
+	reg.MustRegister(m.acquisitions, m.conflicts, m.renewals,
+		m.renewFailures, m.releases, m.hold, m.latency)
+
+	return m
+}
+
+// Acquired counts an acquisition.
+func (m *Metrics) Acquired(name string) {
+	m.acquisitions.WithLabelValues(name).Inc()
+}
+
+// Conflict counts an acquisition that found the lock held.
+func (m *Metrics) Conflict(name string) {
+	m.conflicts.WithLabelValues(name).Inc()
+}
+
+// Renewed counts a renewal.
+func (m *Metrics) Renewed(name string) {
+	m.renewals.WithLabelValues(name).Inc()
+}
+
+// RenewFailed counts a failed renewal.
+func (m *Metrics) RenewFailed(name string, err error) {
+	m.renewFailures.WithLabelValues(name).Inc()
+}
+
+// Released counts a release and records the hold duration.
+func (m *Metrics) Released(name string, held time.Duration) {
+	m.releases.WithLabelValues(name).Inc()
+	if held > 0 {
+		m.hold.WithLabelValues(name).Observe(held.Seconds())
+	}
+}
+
+// Latency records the duration of an operation.
+func (m *Metrics) Latency(name string, op ddblock.Op, d time.Duration, err error) {
+	outcome := "ok"
+	switch {
+	case op == ddblock.OpAcquire && ddblock.IsAquireError(err):
+		outcome = "conflict"
+	case err != nil:
+		outcome = "error"
+	}
+
+	m.latency.WithLabelValues(name, op.String(), outcome).Observe(d.Seconds())
+}
@@ -0,0 +1,48 @@
+// Package protocodec provides a ddblock.Codec that encodes
+// lock payloads as protocol buffers.
+package protocodec
+
+import (
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes payloads that are proto.Message values, usually
+// pointers to generated message types, like ddblock.TypedLock[*pb.Job].
+type Codec struct{}
+
+// Marshal encodes the message v.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protocodec: %T is not a proto.Message", v)
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes data into v, a proto.Message or a pointer to one.
+// A nil message pointed to is allocated first.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Ptr {
+		return fmt.Errorf("protocodec: %T is not a pointer to a proto.Message", v)
+	}
+
+	if rv.Elem().IsNil() {
+		rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+	}
+
+	m, ok := rv.Elem().Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("protocodec: %T is not a pointer to a proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,222 @@
+// Package redisbackend stores ddblock locks in Redis, for example ElastiCache,
+// instead of a DynamoDB table:
+//
+//	b := redisbackend.New(redis.NewClient(&redis.Options{Addr: addr}))
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(b))
+//
+// A free lock is taken with SET NX PX, takeovers, renewals and releases
+// are compare-and-set Lua scripts on the holder's UUID. Each lock is one key
+// whose value is the JSON encoded lease.
+package redisbackend
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/paulmach/ddblock"
+	"github.com/redis/go-redis/v9"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultCleanupDelay is how long after a lease expires Redis deletes the key.
+// Until then the lapsed lease is returned as the previous one on takeover.
+var DefaultCleanupDelay = time.Hour
+
+// Backend is a ddblock.Backend storing locks in Redis.
+type Backend struct {
+	Client redis.UniversalClient
+
+	// Prefix is added to the lock names to make the keys.
+	Prefix string
+
+	// CleanupDelay defaults to DefaultCleanupDelay.
+	CleanupDelay time.Duration
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates a backend using the client.
+func New(client redis.UniversalClient) *Backend {
+	return &Backend{
+		Client: client,
+	}
+}
+
+// record is the value stored in the key. The uuid and expires, in unix
+// milliseconds, are read by the scripts.
+type record struct {
+	UUID    string            `json:"uuid"`
+	Expires int64             `json:"expires"`
+	Lease   *ddblock.LockInfo `json:"lease"`
+}
+
+// takeover sets the key if it is free, expired before the cutoff
+// or has the same uuid. It returns {1, previous value} or {0} if held.
+var takeover = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local l = cjson.decode(cur)
+	if l.uuid ~= ARGV[2] and tonumber(l.expires) >= tonumber(ARGV[3]) then
+		return {0}
+	end
+	if l.uuid == ARGV[2] then
+		cur = ''
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[4])
+return {1, cur or ''}
+`)
+
+// renew sets the key if it has the same uuid, returning 1 if set.
+var renew = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if not cur or cjson.decode(cur).uuid ~= ARGV[2] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 1
+`)
+
+// release deletes the key if it has the uuid, returning 1 if deleted.
+var release = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if not cur or cjson.decode(cur).uuid ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	value, px, err := b.encode(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	key := b.Prefix + lease.Name
+	ok, err := b.Client.SetNX(ctx, key, value, px).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		return nil, nil
+	}
+
+	res, err := takeover.Run(ctx, b.Client, []string{key},
+		value, lease.UUID, cutoff.UnixNano()/int64(time.Millisecond), px.Milliseconds()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, ok := res.([]interface{})
+	if !ok || len(reply) == 0 {
+		return nil, fmt.Errorf("ddblock/redisbackend: unexpected reply %v", res)
+	}
+
+	if n, _ := reply[0].(int64); n == 0 {
+		return nil, ddblock.ErrConflict
+	}
+
+	if len(reply) < 2 {
+		return nil, nil
+	}
+
+	previous, _ := reply[1].(string)
+	if previous == "" {
+		return nil, nil
+	}
+
+	return decode([]byte(previous))
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	value, px, err := b.encode(lease)
+	if err != nil {
+		return err
+	}
+
+	n, err := renew.Run(ctx, b.Client, []string{b.Prefix + lease.Name},
+		value, lease.UUID, px.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ddblock.ErrConflict
+	}
+
+	return nil
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	n, err := release.Run(ctx, b.Client, []string{b.Prefix + name}, uuid).Int64()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ddblock.ErrConflict
+	}
+
+	return nil
+}
+
+// Get returns the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	data, err := b.Client.Get(ctx, b.Prefix+name).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(data)
+}
+
+// encode returns the value of the lease and how long the key should live.
+func (b *Backend) encode(lease *ddblock.LockInfo) (string, time.Duration, error) {
+	data, err := json.Marshal(record{
+		UUID:    lease.UUID,
+		Expires: lease.Expires.UnixNano() / int64(time.Millisecond),
+		Lease:   lease,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	delay := b.CleanupDelay
+	if delay <= 0 {
+		delay = DefaultCleanupDelay
+	}
+
+	px := time.Until(lease.Expires) + delay
+	if px < time.Millisecond {
+		px = time.Millisecond
+	}
+
+	return string(data), px, nil
+}
+
+func decode(data []byte) (*ddblock.LockInfo, error) {
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	if r.Lease == nil {
+		r.Lease = &ddblock.LockInfo{}
+	}
+
+	r.Lease.UUID = r.UUID
+	r.Lease.Expires = time.Unix(0, r.Expires*int64(time.Millisecond))
+	return r.Lease, nil
+}
@@ -0,0 +1,97 @@
+package ddblock
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultReleaseRetries is how many times a failed release is retried in
+// the background, with exponential backoff starting at a second.
+var DefaultReleaseRetries = 5
+
+// maxPendingReleases limits the releases retried in the background at
+// once. Beyond it Unlock returns the error.
+const maxPendingReleases = 1000
+
+var (
+	pendingReleases int
+	releasesIdle    = make(chan struct{})
+	releasesLk      sync.Mutex
+)
+
+func init() {
+	close(releasesIdle)
+}
+
+// WaitReleases waits until the failed releases being retried in the
+// background are done, or the context is done. Call it before the
+// process exits so the locks are not left held for a full TTL.
+func WaitReleases(ctx context.Context) error {
+	releasesLk.Lock()
+	idle := releasesIdle
+	releasesLk.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queueRelease retries the release in the background. It returns false if
+// retries are disabled or too many releases are already pending.
+// Must be called with m.lk held.
+func (m *Mutex) queueRelease(release func() error) bool {
+	retries := m.ReleaseRetries
+	if retries == 0 {
+		retries = DefaultReleaseRetries
+	}
+
+	if retries < 0 {
+		return false
+	}
+
+	releasesLk.Lock()
+	defer releasesLk.Unlock()
+
+	if pendingReleases >= maxPendingReleases {
+		return false
+	}
+
+	if pendingReleases == 0 {
+		releasesIdle = make(chan struct{})
+	}
+	pendingReleases++
+
+	go retryRelease(release, retries)
+	return true
+}
+
+// retryRelease calls release until it succeeds, finds the lock is no longer
+// held, or runs out of retries.
+func retryRelease(release func() error, retries int) {
+	defer func() {
+		releasesLk.Lock()
+		defer releasesLk.Unlock()
+
+		pendingReleases--
+		if pendingReleases == 0 {
+			close(releasesIdle)
+		}
+	}()
+
+	wait := time.Second
+	for i := 0; i < retries; i++ {
+		time.Sleep(wait)
+		wait *= 2
+
+		err := release()
+		if err == nil || IsAquireError(err) {
+			// released, or expired and maybe taken by another
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package ddblock
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultErrorInterval is how often repeated renewal errors are reported.
+var DefaultErrorInterval = time.Minute
+
+// ErrRenewVetoed is the reason a lease was lost after
+// ShouldRenew skipped renewals until it lapsed.
+var ErrRenewVetoed = errors.New("ddbmutex: renewal vetoed until the lease lapsed")
+
+// heartbeat renews the lease in the background until the mutex is unlocked,
+// which cancels the context of the lease, or the mutex's context is canceled,
+// which releases it. Failed renewals are retried until the lease lapses, at
+// which point the lock is considered lost and Lost is signaled.
+func (m *Mutex) heartbeat(ctx context.Context) {
+	wait := m.nextRenewal()
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			if m.ctx.Err() != nil {
+				m.Unlock()
+			}
+
+			return
+		}
+
+		var ok bool
+		if m.ShouldRenew != nil && !m.ShouldRenew() {
+			if wait, ok = m.vetoed(); !ok {
+				m.lapsed(ErrRenewVetoed)
+				return
+			}
+
+			continue
+		}
+
+		err := m.update()
+		switch {
+		case err == nil:
+			m.lk.Lock()
+			m.failures = 0
+			m.lk.Unlock()
+
+			wait = m.nextRenewal()
+			continue
+		case err == ErrNotHeld || err == ErrLockLost || err == ErrMaxHoldTime:
+			// unlocked, or lost and already signaled
+			return
+		}
+
+		if wait, ok = m.renewalRetry(err); !ok {
+			m.lapsed(err)
+			return
+		}
+	}
+}
+
+// vetoed returns how long to wait before asking ShouldRenew again after
+// it skipped a renewal. False is returned if the lease has already lapsed.
+func (m *Mutex) vetoed() (time.Duration, bool) {
+	m.lk.Lock()
+	remaining := m.remaining()
+	m.lk.Unlock()
+
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	return m.retryWait(remaining), true
+}
+
+// lapsed gives up the lease that could not be renewed in time.
+func (m *Mutex) lapsed(err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" || m.renewed.IsZero() {
+		// unlocked meanwhile
+		return
+	}
+
+	m.audit(AuditLost, nil)
+	m.loseLease(err)
+}
+
+// renewalRetry reports a failed renewal and returns how long to wait before
+// trying again, so there are a few attempts before the lease lapses. False is
+// returned if the lease has already lapsed or MaxRenewFailures is reached.
+func (m *Mutex) renewalRetry(err error) (time.Duration, bool) {
+	m.lk.Lock()
+	remaining := m.remaining()
+	m.failures++
+	exhausted := m.MaxRenewFailures > 0 && m.failures >= m.MaxRenewFailures
+	m.lk.Unlock()
+
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	m.reportRenewError(err)
+	if exhausted {
+		return 0, false
+	}
+
+	return m.retryWait(remaining), true
+}
+
+// retryWait returns the RetryInterval, limited to half of the
+// remaining lease so there is more than one attempt.
+func (m *Mutex) retryWait(remaining time.Duration) time.Duration {
+	wait := m.RetryInterval
+	if wait <= 0 || wait > remaining/2 {
+		wait = remaining / 2
+	}
+
+	return wait
+}
+
+// errorReporter rate limits and deduplicates errors.
+type errorReporter struct {
+	last       time.Time
+	key        string
+	suppressed int
+}
+
+// report returns true if the error should be reported now along with
+// the number of similar errors suppressed since the last report.
+func (r *errorReporter) report(err error, interval time.Duration) (bool, int) {
+	now := time.Now()
+	key := errorKey(err)
+	if key == r.key && now.Sub(r.last) < interval {
+		r.suppressed++
+		return false, 0
+	}
+
+	suppressed := r.suppressed
+	r.last, r.key, r.suppressed = now, key, 0
+
+	return true, suppressed
+}
+
+// errorKey identifies similar errors. The message of an aws error
+// includes its request id, so those are compared by code.
+func errorKey(err error) string {
+	var e awserr.Error
+	if errors.As(err, &e) {
+		return "aws: " + e.Code()
+	}
+
+	return err.Error()
+}
+
+// reportRenewError reports a failed background renewal to OnRenewError,
+// or the Logger, unless a similar error was reported recently.
+func (m *Mutex) reportRenewError(err error) {
+	interval := m.ErrorInterval
+	if interval <= 0 {
+		interval = DefaultErrorInterval
+	}
+
+	m.lk.Lock()
+	ok, suppressed := m.errors.report(err, interval)
+	m.lk.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if m.OnRenewError != nil {
+		m.OnRenewError(err, suppressed)
+		return
+	}
+
+	m.logger().Warn("ddblock: renewing lease", "lock", m.name, "error", err, "suppressed", suppressed)
+}
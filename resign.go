@@ -0,0 +1,81 @@
+package ddblock
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+var steppingDownString = "stepping_down"
+
+// DefaultDrainWindow is how long a graceful Resign keeps the lock
+// after marking it as stepping down.
+var DefaultDrainWindow = 10 * time.Second
+
+// Resign gives up the lock. If graceful, the lock item is first marked as
+// stepping down, visible to watchers as an EventSteppingDown and on
+// LockInfo, then the lease is kept renewed for the DrainWindow before being
+// released. This lets a successor warm up before traffic cuts over.
+// Canceling the context ends the drain window early. If the lock is taken
+// by someone else meanwhile, Taken and ErrLockLost are returned.
+func (m *Mutex) Resign(ctx context.Context, graceful bool) (Ownership, error) {
+	if graceful {
+		err := m.stepDown(ctx)
+		if err == ErrLockLost {
+			// taken by someone else while stepping down
+			return Taken, err
+		}
+
+		if err != nil && err != ErrNotHeld {
+			return NotHeld, err
+		}
+	}
+
+	return m.Release()
+}
+
+// stepDown marks the lock as stepping down and keeps
+// renewing it until the end of the drain window.
+func (m *Mutex) stepDown(ctx context.Context) error {
+	m.lk.Lock()
+	m.steppingDown = true
+	m.lk.Unlock()
+
+	if err := m.update(); err != nil {
+		return err
+	}
+
+	drain := m.DrainWindow
+	if drain <= 0 {
+		drain = DefaultDrainWindow
+	}
+
+	end := time.After(drain)
+	for {
+		// the heartbeat keeps renewing unless renewal is manual
+		var renew <-chan time.Time
+		if m.ManualRenew {
+			renew = time.After(m.nextRenewal())
+		}
+
+		select {
+		case <-end:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-renew:
+		}
+
+		if err := m.update(); err != nil {
+			return err
+		}
+	}
+}
+
+// steppingDownAttribute marks an item as stepping down.
+func steppingDownAttribute() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+}
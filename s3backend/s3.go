@@ -0,0 +1,233 @@
+// Package s3backend stores ddblock locks as objects in an S3 bucket, for
+// teams that want no infrastructure beyond a bucket:
+//
+//	b := s3backend.New(s3.New(sess), "my-bucket", "locks/")
+//	m := ddblock.New(ctx, "name", ddblock.WithBackend(b))
+//
+// Each lock is an object whose body is the JSON encoded lease and whose
+// metadata has the holder's uuid and the expiry. A free lock is taken with
+// a conditional put, If-None-Match, and takeovers, renewals and releases
+// are conditional on the ETag, If-Match. S3 requests are slower than
+// DynamoDB, use TTLs of tens of seconds or more.
+package s3backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/paulmach/ddblock"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	uuidMetadata    = "Ddblock-Uuid"
+	expiresMetadata = "Ddblock-Expires"
+)
+
+// Backend is a ddblock.Backend storing locks in S3.
+type Backend struct {
+	Client s3iface.S3API
+	Bucket string
+
+	// Prefix is added to the lock names to make the object keys.
+	Prefix string
+}
+
+var _ ddblock.Backend = &Backend{}
+
+// New creates a backend storing the locks in the bucket under the prefix.
+func New(client s3iface.S3API, bucket, prefix string) *Backend {
+	return &Backend{
+		Client: client,
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+}
+
+// Put stores the lease if the lock is free, expired before the cutoff
+// or has the same UUID.
+func (b *Backend) Put(ctx context.Context, lease *ddblock.LockInfo, cutoff time.Time) (*ddblock.LockInfo, error) {
+	err := b.put(ctx, lease, ifNoneMatch("*"))
+	if err != ddblock.ErrConflict {
+		return nil, err
+	}
+
+	current, etag, err := b.get(ctx, lease.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		// released in the meantime, only one of the racing puts wins
+		return nil, b.put(ctx, lease, ifNoneMatch("*"))
+	}
+
+	if current.UUID != lease.UUID && !current.Expires.Before(cutoff) {
+		return nil, ddblock.ErrConflict
+	}
+
+	if err := b.put(ctx, lease, ifMatch(etag)); err != nil {
+		return nil, err
+	}
+
+	if current.UUID == lease.UUID {
+		return nil, nil
+	}
+
+	return current, nil
+}
+
+// Renew replaces the lease if the stored one has the same UUID.
+func (b *Backend) Renew(ctx context.Context, lease *ddblock.LockInfo) error {
+	current, etag, err := b.get(ctx, lease.Name)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || current.UUID != lease.UUID {
+		return ddblock.ErrConflict
+	}
+
+	return b.put(ctx, lease, ifMatch(etag))
+}
+
+// Delete removes the lease if it has the UUID.
+func (b *Backend) Delete(ctx context.Context, name, uuid string) error {
+	current, etag, err := b.get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || current.UUID != uuid {
+		return ddblock.ErrConflict
+	}
+
+	_, err = b.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.Bucket,
+		Key:    aws.String(b.Prefix + name),
+	}, ifMatch(etag))
+	return conflict(err)
+}
+
+// Get returns the lease of the named lock, nil if there is none.
+func (b *Backend) Get(ctx context.Context, name string) (*ddblock.LockInfo, error) {
+	lease, _, err := b.get(ctx, name)
+	return lease, err
+}
+
+// get returns the lease of the named lock and the ETag of its object.
+func (b *Backend) get(ctx context.Context, name string) (*ddblock.LockInfo, *string, error) {
+	resp, err := b.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &b.Bucket,
+		Key:    aws.String(b.Prefix + name),
+	})
+	if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lease := &ddblock.LockInfo{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, nil, err
+	}
+
+	// the metadata is authoritative, it is what the conditions were written with
+	if v := metadata(resp.Metadata, uuidMetadata); v != "" {
+		lease.UUID = v
+	}
+
+	if v := metadata(resp.Metadata, expiresMetadata); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			lease.Expires = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+
+	return lease, resp.ETag, nil
+}
+
+// put writes the lease with the condition.
+func (b *Backend) put(ctx context.Context, lease *ddblock.LockInfo, cond request.Option) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &b.Bucket,
+		Key:         aws.String(b.Prefix + lease.Name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		Metadata: map[string]*string{
+			uuidMetadata:    aws.String(lease.UUID),
+			expiresMetadata: aws.String(strconv.FormatInt(lease.Expires.UnixNano()/int64(time.Millisecond), 10)),
+		},
+	}, cond)
+	return conflict(err)
+}
+
+// ifNoneMatch and ifMatch make the request conditional. The SDK does not
+// model the conditional write headers so they are set once the request
+// is built.
+func ifNoneMatch(etag string) request.Option {
+	return header("If-None-Match", etag)
+}
+
+func ifMatch(etag *string) request.Option {
+	return header("If-Match", aws.StringValue(etag))
+}
+
+func header(name, value string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set(name, value)
+		})
+	}
+}
+
+// conflict maps failed conditional requests to ErrConflict.
+func conflict(err error) error {
+	if e, ok := err.(awserr.RequestFailure); ok &&
+		(e.StatusCode() == http.StatusPreconditionFailed || e.StatusCode() == http.StatusConflict) {
+		return ddblock.ErrConflict
+	}
+
+	if e, ok := err.(awserr.Error); ok {
+		switch e.Code() {
+		case "PreconditionFailed", "ConditionalRequestConflict", s3.ErrCodeNoSuchKey:
+			return ddblock.ErrConflict
+		}
+	}
+
+	return err
+}
+
+// metadata looks up a key ignoring case, S3 may return it canonicalized.
+func metadata(m map[string]*string, key string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+
+	return ""
+}
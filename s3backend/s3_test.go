@@ -0,0 +1,121 @@
+package s3backend_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/paulmach/ddblock"
+	"github.com/paulmach/ddblock/conformance"
+	"github.com/paulmach/ddblock/s3backend"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() ddblock.Backend {
+		return s3backend.New(newFakeS3(), "bucket", "locks/")
+	})
+}
+
+type object struct {
+	data     []byte
+	metadata map[string]*string
+	etag     string
+}
+
+// fakeS3 keeps the objects in memory and honors the
+// If-Match and If-None-Match headers of the requests.
+type fakeS3 struct {
+	s3iface.S3API
+
+	lk      sync.Mutex
+	objects map[string]*object
+	version int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]*object)}
+}
+
+// headers returns the headers the options set on the request.
+func headers(opts []request.Option) http.Header {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(opts...)
+	r.Handlers.Build.Run(r)
+
+	return r.HTTPRequest.Header
+}
+
+// precondition returns the error of a failed condition, nil if it holds.
+func precondition(h http.Header, current *object) error {
+	failed := awserr.NewRequestFailure(awserr.New("PreconditionFailed", "precondition failed", nil), http.StatusPreconditionFailed, "")
+
+	if v := h.Get("If-None-Match"); v == "*" && current != nil {
+		return failed
+	}
+
+	if v := h.Get("If-Match"); v != "" && (current == nil || current.etag != v) {
+		return failed
+	}
+
+	return nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, params *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if err := precondition(headers(opts), f.objects[*params.Key]); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.version++
+	o := &object{
+		data:     data,
+		metadata: params.Metadata,
+		etag:     strconv.Quote(strconv.Itoa(f.version)),
+	}
+	f.objects[*params.Key] = o
+
+	return &s3.PutObjectOutput{ETag: aws.String(o.etag)}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, params *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	o := f.objects[*params.Key]
+	if o == nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(o.data)),
+		Metadata: o.metadata,
+		ETag:     aws.String(o.etag),
+	}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(ctx aws.Context, params *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if err := precondition(headers(opts), f.objects[*params.Key]); err != nil {
+		return nil, err
+	}
+
+	delete(f.objects, *params.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
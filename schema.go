@@ -0,0 +1,110 @@
+package ddblock
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Schema maps the attributes of the lock items to the names used by the
+// table, so locks can share a pre-existing table, for example one whose
+// hash key is called "pk". Empty names, or a nil schema, use the
+// DefaultSchema.
+//
+// Tables with a composite key, as in a single table design, are supported
+// by setting SortKey. Every lock item then has the SortValue as its sort key
+// and the partition key is the lock name with its prefix, for example
+// PK="LOCK#<name>" and SK="LOCK" with the "LOCK#" prefix.
+type Schema struct {
+	// Key is the hash key attribute, holding the name of the lock.
+	Key string
+
+	// SortKey is the sort key attribute of a table with a composite key,
+	// SortValue the string stored in it. They are not used if empty.
+	SortKey   string
+	SortValue string
+
+	// UUID holds the token of the lease and Expires when it expires.
+	UUID    string
+	Expires string
+
+	// ExpiryIndex, if set, is the name of a global secondary index of the
+	// lock items by expiry, so Inspector.ListExpiredLocks queries instead of
+	// scanning the table. The items then have an "expiry_partition" attribute,
+	// always "lock", which is the hash key of the index, and Expires is its
+	// sort key. EnsureTable creates the index.
+	ExpiryIndex string
+}
+
+// DefaultSchema names the attributes of tables created by EnsureTable.
+var DefaultSchema = &Schema{
+	Key:     "name",
+	UUID:    "uuid",
+	Expires: "expires",
+}
+
+// keyName returns the name of the hash key attribute.
+func (s *Schema) keyName() string {
+	if s == nil || s.Key == "" {
+		return DefaultSchema.Key
+	}
+
+	return s.Key
+}
+
+// uuidName returns the name of the lease token attribute.
+func (s *Schema) uuidName() string {
+	if s == nil || s.UUID == "" {
+		return DefaultSchema.UUID
+	}
+
+	return s.UUID
+}
+
+// expiresName returns the name of the expiry attribute.
+func (s *Schema) expiresName() string {
+	if s == nil || s.Expires == "" {
+		return DefaultSchema.Expires
+	}
+
+	return s.Expires
+}
+
+// expiryPartitionString is the hash key of the ExpiryIndex, with
+// the same value on every lock item so they can all be queried.
+var expiryPartitionString = "expiry_partition"
+
+const expiryPartition = "lock"
+
+// expiryIndex returns the name of the ExpiryIndex, empty if there is none.
+func (s *Schema) expiryIndex() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.ExpiryIndex
+}
+
+// sortKeyName returns the name of the sort key attribute,
+// empty if the table does not have a composite key.
+func (s *Schema) sortKeyName() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.SortKey
+}
+
+// key returns the key of the named item.
+func (s *Schema) key(name string) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{
+		s.keyName(): {
+			S: &name,
+		},
+	}
+
+	if sk := s.sortKeyName(); sk != "" {
+		key[sk] = &dynamodb.AttributeValue{S: aws.String(s.SortValue)}
+	}
+
+	return key
+}
@@ -0,0 +1,428 @@
+package ddblock
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	usedString    = "used"
+	permitsString = "permits"
+)
+
+// ErrTooManyPermits is returned when acquiring more permits than the
+// semaphore has, or releasing more than are held.
+var ErrTooManyPermits = errors.New("ddbmutex: more permits than the semaphore has or holds")
+
+// Semaphore is a weighted counting semaphore with a number of permits shared
+// by every process using the same name, to limit the total concurrency of a
+// job across a fleet. It is stored in one item, the name with "#semaphore",
+// with the number of permits used and, per holder, its permits and expiry.
+// Held permits are renewed in the background, Lost signals if that fails.
+// The permits of holders whose lease lapsed are reclaimed by the next
+// acquisition that needs them.
+type Semaphore struct {
+	TableName string
+
+	// TTL is the lease of the held permits, DefaultTTL if zero.
+	TTL           time.Duration
+	RetryInterval time.Duration
+
+	// Permits is the size of the semaphore. All users of the
+	// semaphore must agree on it.
+	Permits int64
+
+	// Schema names the key attribute of the item, DefaultSchema if nil.
+	Schema *Schema
+
+	name     string
+	fullname string
+	uuid     string
+	svc      dynamodbiface.DynamoDBAPI
+
+	lk      sync.Mutex
+	held    int64
+	renewed time.Time
+	stop    chan struct{}
+	lost    chan struct{}
+	lostErr error
+}
+
+// NewSemaphore creates a semaphore with the given name and permits.
+func NewSemaphore(name string, permits int64) *Semaphore {
+	return &Semaphore{
+		TableName:     DefaultTableName,
+		TTL:           DefaultTTL,
+		RetryInterval: DefaultRetryInterval,
+		Permits:       permits,
+		name:          name,
+		fullname:      DefaultPrefix + name,
+		uuid:          newUUID(),
+	}
+}
+
+// Held returns the number of permits held by this semaphore.
+func (s *Semaphore) Held() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.held
+}
+
+// Lost returns a channel that is closed if the held permits, or the next
+// ones, are lost, because they were reclaimed by another holder after their
+// lease lapsed or renewals failed until it did, but not when they are
+// released. Err returns the reason.
+func (s *Semaphore) Lost() <-chan struct{} {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.lost == nil {
+		s.lost = make(chan struct{})
+	}
+
+	return s.lost
+}
+
+// Err returns why the permits were last lost, ErrLockLost if they were
+// reclaimed or the last renewal error if they lapsed. It is nil otherwise.
+func (s *Semaphore) Err() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.lostErr
+}
+
+// Acquire waits for n permits or until the context is done.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	for {
+		err := s.TryAcquire(ctx, n)
+		if !IsAquireError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(s.RetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquire takes n permits without waiting. A conditional check failure,
+// see IsAquireError, means not enough permits are free.
+func (s *Semaphore) TryAcquire(ctx context.Context, n int64) error {
+	if n <= 0 || n > s.Permits {
+		return ErrTooManyPermits
+	}
+
+	err := s.add(ctx, n)
+	if !IsAquireError(err) {
+		return err
+	}
+
+	// free the permits of lapsed holders and try again if some were
+	if reclaimed, rerr := s.reclaim(ctx); rerr != nil || reclaimed == 0 {
+		return err
+	}
+
+	return s.add(ctx, n)
+}
+
+// Release returns n of the held permits.
+func (s *Semaphore) Release(ctx context.Context, n int64) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if n <= 0 || n > s.held {
+		return ErrTooManyPermits
+	}
+
+	params := &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key(),
+		UpdateExpression:    aws.String("SET #used = #used - :n, #me = :holder"),
+		ConditionExpression: aws.String("#me.#permits = :held"),
+		ExpressionAttributeNames: map[string]*string{
+			"#used":    &usedString,
+			"#me":      aws.String(advisoryHolderPrefix + s.uuid),
+			"#permits": &permitsString,
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":n":      numberAttribute(n),
+			":held":   numberAttribute(s.held),
+			":holder": s.holder(s.held-n, time.Now()),
+		},
+	}
+
+	if s.held == n {
+		params.UpdateExpression = aws.String("SET #used = #used - :n REMOVE #me")
+		delete(params.ExpressionAttributeValues, ":holder")
+	}
+
+	_, err := s.db().UpdateItemWithContext(ctx, params)
+	if IsAquireError(err) {
+		// lapsed and reclaimed by another
+		s.forget(ErrLockLost)
+		return ErrLockLost
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.held -= n
+	if s.held == 0 {
+		s.forget(nil)
+	}
+
+	return nil
+}
+
+// add takes n more permits if they are free.
+func (s *Semaphore) add(ctx context.Context, n int64) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+	params := &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key(),
+		UpdateExpression:    aws.String("SET #used = if_not_exists(#used, :zero) + :n, #me = :holder"),
+		ConditionExpression: aws.String("(attribute_not_exists(#used) OR #used <= :max) AND " + s.heldCondition()),
+		ExpressionAttributeNames: map[string]*string{
+			"#used": &usedString,
+			"#me":   aws.String(advisoryHolderPrefix + s.uuid),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":   numberAttribute(0),
+			":n":      numberAttribute(n),
+			":max":    numberAttribute(s.Permits - n),
+			":holder": s.holder(s.held+n, now),
+		},
+	}
+
+	if s.held > 0 {
+		params.ExpressionAttributeNames["#permits"] = &permitsString
+		params.ExpressionAttributeValues[":held"] = numberAttribute(s.held)
+	}
+
+	_, err := s.db().UpdateItemWithContext(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	s.held += n
+	s.renewed = now
+	if s.stop == nil {
+		if s.lost != nil && closed(s.lost) {
+			s.lost, s.lostErr = nil, nil
+		}
+
+		s.stop = make(chan struct{})
+		go s.heartbeat(s.stop)
+	}
+
+	return nil
+}
+
+// heldCondition is true if our holder attribute matches the held permits.
+// Must be called with s.lk held.
+func (s *Semaphore) heldCondition() string {
+	if s.held == 0 {
+		return "attribute_not_exists(#me)"
+	}
+
+	return "#me.#permits = :held"
+}
+
+// reclaim frees the permits of holders whose lease lapsed
+// and returns how many were freed.
+func (s *Semaphore) reclaim(ctx context.Context) (int64, error) {
+	resp, err := s.db().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &s.TableName,
+		Key:            s.key(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var reclaimed int64
+	for k, v := range resp.Item {
+		if !strings.HasPrefix(k, advisoryHolderPrefix) || k == advisoryHolderPrefix+s.uuid {
+			continue
+		}
+
+		exp, permits := v.M["expires"], v.M[permitsString]
+		if exp == nil || permits == nil {
+			continue
+		}
+
+		expires, _ := parseExpires(aws.StringValue(exp.N))
+		if expires.After(now) {
+			continue
+		}
+
+		_, err := s.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:           &s.TableName,
+			Key:                 s.key(),
+			UpdateExpression:    aws.String("SET #used = #used - :n REMOVE #h"),
+			ConditionExpression: aws.String("#h.#exp = :exp AND #h.#permits = :n"),
+			ExpressionAttributeNames: map[string]*string{
+				"#used":    &usedString,
+				"#h":       aws.String(k),
+				"#exp":     aws.String("expires"),
+				"#permits": &permitsString,
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":n":   permits,
+				":exp": exp,
+			},
+		})
+		if IsAquireError(err) {
+			// renewed, released or reclaimed by another meanwhile
+			continue
+		}
+
+		if err != nil {
+			return reclaimed, err
+		}
+
+		n, _ := strconv.ParseInt(aws.StringValue(permits.N), 10, 64)
+		reclaimed += n
+	}
+
+	return reclaimed, nil
+}
+
+// heartbeat renews the held permits until they are released or lost.
+func (s *Semaphore) heartbeat(stop chan struct{}) {
+	for {
+		select {
+		case <-time.After(s.ttl() / 2):
+		case <-stop:
+			return
+		}
+
+		s.renew(stop)
+	}
+}
+
+// renew extends the lease of the held permits, if stop is still the
+// current heartbeat's. They are forgotten if they were reclaimed or if the
+// lease lapsed while renewals failed.
+func (s *Semaphore) renew(stop chan struct{}) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.held == 0 || s.stop != stop {
+		return nil
+	}
+
+	// a renewal is pointless once the lease has lapsed
+	ctx, cancel := context.WithDeadline(context.Background(), s.renewed.Add(s.ttl()))
+	defer cancel()
+
+	now := time.Now()
+	_, err := s.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key(),
+		UpdateExpression:    aws.String("SET #me = :holder"),
+		ConditionExpression: aws.String("#me.#permits = :held"),
+		ExpressionAttributeNames: map[string]*string{
+			"#me":      aws.String(advisoryHolderPrefix + s.uuid),
+			"#permits": &permitsString,
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":held":   numberAttribute(s.held),
+			":holder": s.holder(s.held, now),
+		},
+	})
+	if IsAquireError(err) {
+		// lapsed and reclaimed by another
+		s.forget(ErrLockLost)
+		return err
+	}
+
+	if err != nil {
+		if time.Since(s.renewed) >= s.ttl() {
+			s.forget(err)
+		}
+
+		return err
+	}
+
+	s.renewed = now
+	return nil
+}
+
+// forget drops the held permits and stops the heartbeat. If they were
+// lost, err is the reason, Lost is signaled. Must be called with s.lk held.
+func (s *Semaphore) forget(err error) {
+	s.held = 0
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
+	if err != nil {
+		if s.lost == nil {
+			s.lost = make(chan struct{})
+		}
+
+		s.lostErr = err
+		if !closed(s.lost) {
+			close(s.lost)
+		}
+	}
+}
+
+// ttl returns the lease of the held permits.
+func (s *Semaphore) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return DefaultTTL
+	}
+
+	return s.TTL
+}
+
+// holder returns our holder attribute.
+func (s *Semaphore) holder(permits int64, now time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		M: map[string]*dynamodb.AttributeValue{
+			permitsString: numberAttribute(permits),
+			"expires": {
+				N: aws.String(strconv.FormatInt(now.Add(s.ttl()).UnixNano(), 10)),
+			},
+		},
+	}
+}
+
+func (s *Semaphore) db() dynamodbiface.DynamoDBAPI {
+	if s.svc != nil {
+		return s.svc
+	}
+
+	return getSvc()
+}
+
+func (s *Semaphore) key() map[string]*dynamodb.AttributeValue {
+	return s.Schema.key(s.fullname + "#semaphore")
+}
+
+func numberAttribute(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(n, 10)),
+	}
+}
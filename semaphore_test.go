@@ -0,0 +1,153 @@
+package ddblock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+func newTestSemaphore(db *fakeDB, name string, permits int64) *Semaphore {
+	s := NewSemaphore(name, permits)
+	s.RetryInterval = 5 * time.Millisecond
+	s.svc = db
+
+	return s
+}
+
+func TestSemaphore(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	a := newTestSemaphore(db, "permits", 3)
+	b := newTestSemaphore(db, "permits", 3)
+
+	steps := []struct {
+		name    string
+		s       *Semaphore
+		release bool
+		n       int64
+		err     func(error) bool
+	}{
+		{name: "a takes 2", s: a, n: 2},
+		{name: "b can not take 2", s: b, n: 2, err: IsAquireError},
+		{name: "b takes the last", s: b, n: 1},
+		{name: "a can not take more", s: a, n: 1, err: IsAquireError},
+		{name: "a releases 1", s: a, release: true, n: 1},
+		{name: "b takes the released", s: b, n: 1},
+		{name: "more than the semaphore", s: a, n: 4, err: isErr(ErrTooManyPermits)},
+		{name: "more than held", s: b, release: true, n: 3, err: isErr(ErrTooManyPermits)},
+	}
+
+	for _, st := range steps {
+		var err error
+		if st.release {
+			err = st.s.Release(ctx, st.n)
+		} else {
+			err = st.s.TryAcquire(ctx, st.n)
+		}
+
+		if st.err == nil && err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+
+		if st.err != nil && !st.err(err) {
+			t.Fatalf("%s: unexpected error %v", st.name, err)
+		}
+	}
+
+	if a.Held() != 1 || b.Held() != 2 {
+		t.Errorf("held: expected 1 and 2, got %d and %d", a.Held(), b.Held())
+	}
+
+	if used := semaphoreUsed(t, db, a); used != "3" {
+		t.Errorf("used: expected 3, got %v", used)
+	}
+
+	if err := a.Release(ctx, 1); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	if err := b.Release(ctx, 2); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	it := db.get(aws.StringValue(a.key()["name"].S))
+	if used := aws.StringValue(it[usedString].N); used != "0" || len(it) != 2 {
+		t.Errorf("item after release: expected no holders, got %v", it)
+	}
+}
+
+func TestSemaphoreReclaim(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	s := newTestSemaphore(db, "reclaim", 2)
+
+	// a holder that died with both permits
+	it := s.key()
+	it[usedString] = numberAttribute(2)
+	it[advisoryHolderPrefix+"dead"] = &dynamodb.AttributeValue{
+		M: map[string]*dynamodb.AttributeValue{
+			permitsString: numberAttribute(2),
+			"expires":     {N: aws.String(nanos(time.Now().Add(-time.Second)))},
+		},
+	}
+	db.put(it)
+
+	if err := s.TryAcquire(ctx, 1); err != nil {
+		t.Fatalf("acquire of lapsed permits: %v", err)
+	}
+	defer s.Release(ctx, 1)
+
+	if used := semaphoreUsed(t, db, s); used != "1" {
+		t.Errorf("used: expected 1, got %v", used)
+	}
+
+	if db.get(aws.StringValue(s.key()["name"].S))[advisoryHolderPrefix+"dead"] != nil {
+		t.Errorf("the lapsed holder was not removed")
+	}
+}
+
+func TestSemaphoreLost(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	s := newTestSemaphore(db, "lost", 2)
+
+	if err := s.TryAcquire(ctx, 1); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// reclaimed by another after a lapse
+	name := aws.StringValue(s.key()["name"].S)
+	it := db.get(name)
+	delete(it, advisoryHolderPrefix+s.uuid)
+	it[usedString] = numberAttribute(0)
+	db.put(it)
+
+	if err := s.Release(ctx, 1); err != ErrLockLost {
+		t.Errorf("release: expected %v, got %v", ErrLockLost, err)
+	}
+
+	select {
+	case <-s.Lost():
+	default:
+		t.Errorf("lost: not signaled")
+	}
+
+	if s.Held() != 0 {
+		t.Errorf("held: expected 0, got %d", s.Held())
+	}
+}
+
+func isErr(target error) func(error) bool {
+	return func(err error) bool { return err == target }
+}
+
+func semaphoreUsed(t *testing.T, db *fakeDB, s *Semaphore) string {
+	t.Helper()
+
+	it := db.get(aws.StringValue(s.key()["name"].S))
+	return aws.StringValue(it[usedString].N)
+}
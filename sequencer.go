@@ -0,0 +1,440 @@
+package ddblock
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	nextString    = "next"
+	servingString = "serving"
+)
+
+// ErrTurnPassed is returned by TakeTurn if the turn of the ticket was
+// skipped because it was not claimed in time.
+var ErrTurnPassed = errors.New("ddbmutex: turn passed, ticket not claimed in time")
+
+// Sequencer is a ticket lock. Tickets are handed out in increasing order by
+// an atomic counter and the lock is granted strictly in ticket order, so
+// waiters are served first come first served and never starve. A ticket
+// whose turn is not claimed within ClaimTimeout, for example because its
+// holder died, is skipped.
+//
+// It uses two items along side the lock items, the name with "#ticket",
+// the counter, and "#serving", the current turn and its holder.
+type Sequencer struct {
+	TableName string
+
+	// TTL is the lease of a claimed turn, DefaultTTL if zero.
+	TTL time.Duration
+
+	// ClaimTimeout is how long a turn can be left unclaimed before it is
+	// skipped. Defaults to the TTL.
+	ClaimTimeout time.Duration
+
+	// RetryInterval is the delay between checks of the current turn.
+	RetryInterval time.Duration
+
+	// Schema names the attributes of the items, DefaultSchema if nil.
+	Schema *Schema
+
+	name     string
+	fullname string
+	svc      dynamodbiface.DynamoDBAPI
+}
+
+// NewSequencer creates a ticket lock with the given name.
+func NewSequencer(name string) *Sequencer {
+	return &Sequencer{
+		TableName:     DefaultTableName,
+		TTL:           DefaultTTL,
+		RetryInterval: DefaultRetryInterval,
+		name:          name,
+		fullname:      DefaultPrefix + name,
+	}
+}
+
+// Ticket takes the next ticket, numbered from 1. If it is the turn being
+// served, on an idle sequencer, the turn's claim window starts again now.
+func (s *Sequencer) Ticket(ctx context.Context) (int64, error) {
+	resp, err := s.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        &s.TableName,
+		Key:              s.key("#ticket"),
+		UpdateExpression: aws.String("ADD #next :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#next": &nextString,
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {
+				N: aws.String("1"),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	ticket, err := strconv.ParseInt(aws.StringValue(resp.Attributes[nextString].N), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// the conflict is that the ticket is not being served yet
+	if err := s.open(ctx, ticket); err != nil && !IsAquireError(err) {
+		return 0, err
+	}
+
+	return ticket, nil
+}
+
+// open starts the claim window of the turn if it is being served
+// and still unclaimed. The window of an idle sequencer's turn started
+// when the previous one was done, possibly long before its ticket was
+// taken, and the turn could otherwise be skipped right away.
+func (s *Sequencer) open(ctx context.Context, turn int64) error {
+	_, err := s.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key("#serving"),
+		UpdateExpression:    aws.String("SET #exp = :exp"),
+		ConditionExpression: aws.String("#serving = :turn AND attribute_not_exists(#uuid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#serving": &servingString,
+			"#uuid":    aws.String(s.Schema.uuidName()),
+			"#exp":     aws.String(s.Schema.expiresName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":turn": {
+				N: aws.String(strconv.FormatInt(turn, 10)),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(time.Now().Add(s.claimTimeout()).UnixNano(), 10)),
+			},
+		},
+	})
+	return wrapError(err)
+}
+
+// Position returns how many turns are ahead of the ticket,
+// 0 if it is the ticket's turn and negative if it has passed.
+func (s *Sequencer) Position(ctx context.Context, ticket int64) (int64, error) {
+	serving, _, _, err := s.serving(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return ticket - serving, nil
+}
+
+// TakeTurn waits for the turn of the ticket and claims it. Turns still
+// unclaimed after ClaimTimeout, or whose holder's lease lapsed, are skipped
+// on the way. The turn must be finished with Done, it is renewed in the
+// background until then.
+func (s *Sequencer) TakeTurn(ctx context.Context, ticket int64) (*Turn, error) {
+	var (
+		seen  int64
+		since time.Time
+	)
+	for {
+		serving, expires, claimed, err := s.serving(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// An unclaimed turn is only skipped once this waiter has seen it
+		// unclaimed for a whole ClaimTimeout too. Its ticket was taken
+		// before ours, so it has had at least that long to claim it.
+		if serving != seen {
+			seen, since = serving, time.Now()
+		}
+
+		switch {
+		case serving > ticket:
+			return nil, ErrTurnPassed
+		case serving == ticket:
+			return s.claim(ctx, ticket)
+		case time.Now().After(expires) && (claimed || time.Since(since) >= s.claimTimeout()):
+			// unclaimed or lapsed, the conflict is another waiter advancing first
+			if err := s.advance(ctx, serving, ""); err != nil && !IsAquireError(err) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		select {
+		case <-time.After(s.RetryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// serving returns the current turn, when it expires and whether it is
+// claimed, creating the item for the first turn if it does not exist.
+func (s *Sequencer) serving(ctx context.Context) (int64, time.Time, bool, error) {
+	resp, err := s.db().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &s.TableName,
+		Key:            s.key("#serving"),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, time.Time{}, false, wrapError(err)
+	}
+
+	if len(resp.Item) == 0 {
+		// the first turn, open for claiming from now
+		if err := s.advance(ctx, 0, ""); err != nil && !IsAquireError(err) {
+			return 0, time.Time{}, false, err
+		}
+
+		return s.serving(ctx)
+	}
+
+	serving, err := strconv.ParseInt(aws.StringValue(resp.Item[servingString].N), 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+
+	claimed := resp.Item[s.Schema.uuidName()] != nil
+	expires, err := parseExpires(aws.StringValue(resp.Item[s.Schema.expiresName()].N))
+	return serving, expires, claimed, err
+}
+
+// claim takes the current turn for the ticket.
+func (s *Sequencer) claim(ctx context.Context, ticket int64) (*Turn, error) {
+	now := time.Now()
+	t := &Turn{
+		Ticket:  ticket,
+		seq:     s,
+		uuid:    newUUID(),
+		done:    make(chan struct{}),
+		lost:    make(chan struct{}),
+		renewed: now,
+	}
+
+	_, err := s.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key("#serving"),
+		UpdateExpression:    aws.String("SET #uuid = :uuid, #exp = :exp"),
+		ConditionExpression: aws.String("#serving = :ticket AND attribute_not_exists(#uuid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#serving": &servingString,
+			"#uuid":    aws.String(s.Schema.uuidName()),
+			"#exp":     aws.String(s.Schema.expiresName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uuid": {
+				S: &t.uuid,
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(s.ttl()).UnixNano(), 10)),
+			},
+			":ticket": {
+				N: aws.String(strconv.FormatInt(ticket, 10)),
+			},
+		},
+	})
+	if IsAquireError(err) {
+		// skipped by another waiter meanwhile
+		return nil, ErrTurnPassed
+	}
+
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	go t.heartbeat()
+	return t, nil
+}
+
+// advance moves from the turn to the next one, which can be claimed
+// until ClaimTimeout from now. If uuid is set the turn must have been
+// claimed by it, otherwise the turn must be unclaimed or lapsed.
+func (s *Sequencer) advance(ctx context.Context, turn int64, uuid string) error {
+	now := time.Now()
+	params := &dynamodb.UpdateItemInput{
+		TableName:           &s.TableName,
+		Key:                 s.key("#serving"),
+		UpdateExpression:    aws.String("SET #serving = :next, #exp = :exp REMOVE #uuid"),
+		ConditionExpression: aws.String("#serving = :turn AND #exp < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#serving": &servingString,
+			"#uuid":    aws.String(s.Schema.uuidName()),
+			"#exp":     aws.String(s.Schema.expiresName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":turn": {
+				N: aws.String(strconv.FormatInt(turn, 10)),
+			},
+			":next": {
+				N: aws.String(strconv.FormatInt(turn+1, 10)),
+			},
+			":exp": {
+				N: aws.String(strconv.FormatInt(now.Add(s.claimTimeout()).UnixNano(), 10)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.UnixNano(), 10)),
+			},
+		},
+	}
+
+	if turn == 0 {
+		params.ConditionExpression = aws.String("attribute_not_exists(#serving)")
+		delete(params.ExpressionAttributeValues, ":turn")
+		delete(params.ExpressionAttributeValues, ":now")
+	} else if uuid != "" {
+		params.ConditionExpression = aws.String("#serving = :turn AND #uuid = :uuid")
+		params.ExpressionAttributeValues[":uuid"] = &dynamodb.AttributeValue{S: &uuid}
+		delete(params.ExpressionAttributeValues, ":now")
+	}
+
+	_, err := s.db().UpdateItemWithContext(ctx, params)
+	return wrapError(err)
+}
+
+// ttl returns the lease of a claimed turn.
+func (s *Sequencer) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return DefaultTTL
+	}
+
+	return s.TTL
+}
+
+// claimTimeout returns how long a turn can be left unclaimed.
+func (s *Sequencer) claimTimeout() time.Duration {
+	if s.ClaimTimeout <= 0 {
+		return s.ttl()
+	}
+
+	return s.ClaimTimeout
+}
+
+func (s *Sequencer) db() dynamodbiface.DynamoDBAPI {
+	if s.svc != nil {
+		return s.svc
+	}
+
+	return getSvc()
+}
+
+func (s *Sequencer) key(suffix string) map[string]*dynamodb.AttributeValue {
+	return s.Schema.key(s.fullname + suffix)
+}
+
+// Turn is a claimed turn of a Sequencer, holding the lock.
+type Turn struct {
+	Ticket int64
+
+	seq     *Sequencer
+	uuid    string
+	once    sync.Once
+	done    chan struct{}
+	renewed time.Time
+
+	lk      sync.Mutex
+	lost    chan struct{}
+	lostErr error
+}
+
+// Lost returns a channel that is closed if the turn is lost before it is
+// done, because renewals failed until it lapsed or it was skipped after
+// lapsing. The holder should stop its work, Err returns the reason.
+func (t *Turn) Lost() <-chan struct{} {
+	return t.lost
+}
+
+// Err returns why the turn was lost, ErrLockLost if it was skipped or the
+// last renewal error if it lapsed. It is nil otherwise.
+func (t *Turn) Err() error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return t.lostErr
+}
+
+// lose signals that the turn was lost.
+func (t *Turn) lose(err error) {
+	t.lk.Lock()
+	t.lostErr = err
+	t.lk.Unlock()
+
+	close(t.lost)
+}
+
+// Done finishes the turn, passing the lock to the next ticket.
+// ErrLockLost is returned if the turn lapsed and was skipped,
+// or was already done.
+func (t *Turn) Done(ctx context.Context) error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+
+	err := t.seq.advance(ctx, t.Ticket, t.uuid)
+	if IsAquireError(err) {
+		return ErrLockLost
+	}
+
+	return err
+}
+
+// heartbeat extends the turn until it is done.
+func (t *Turn) heartbeat() {
+	ttl := t.seq.ttl()
+	for {
+		select {
+		case <-time.After(ttl / 2):
+		case <-t.done:
+			return
+		}
+
+		// a renewal is pointless once the turn has lapsed
+		ctx, cancel := context.WithDeadline(context.Background(), t.renewed.Add(ttl))
+		now := time.Now()
+		_, err := t.seq.db().UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:           &t.seq.TableName,
+			Key:                 t.seq.key("#serving"),
+			UpdateExpression:    aws.String("SET #exp = :exp"),
+			ConditionExpression: aws.String("#uuid = :uuid"),
+			ExpressionAttributeNames: map[string]*string{
+				"#uuid": aws.String(t.seq.Schema.uuidName()),
+				"#exp":  aws.String(t.seq.Schema.expiresName()),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":uuid": {
+					S: &t.uuid,
+				},
+				":exp": {
+					N: aws.String(strconv.FormatInt(now.Add(ttl).UnixNano(), 10)),
+				},
+			},
+		})
+		cancel()
+
+		if IsAquireError(err) {
+			// skipped after lapsing
+			t.lose(ErrLockLost)
+			return
+		}
+
+		if err != nil {
+			if time.Since(t.renewed) >= ttl {
+				t.lose(err)
+				return
+			}
+
+			continue
+		}
+
+		t.renewed = now
+	}
+}
@@ -0,0 +1,170 @@
+package ddblock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"golang.org/x/net/context"
+)
+
+func newTestSequencer(db *fakeDB, name string) *Sequencer {
+	s := NewSequencer(name)
+	s.TTL = time.Second
+	s.ClaimTimeout = 100 * time.Millisecond
+	s.RetryInterval = 5 * time.Millisecond
+	s.svc = db
+
+	return s
+}
+
+// takeTurn returns the channel that receives the turn of the ticket.
+func takeTurn(ctx context.Context, s *Sequencer, ticket int64) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		turn, err := s.TakeTurn(ctx, ticket)
+		if err == nil {
+			err = turn.Done(ctx)
+		}
+		result <- err
+	}()
+
+	return result
+}
+
+func TestSequencerOrder(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSequencer(newFakeDB(), "order")
+
+	for want := int64(1); want <= 3; want++ {
+		ticket, err := s.Ticket(ctx)
+		if err != nil {
+			t.Fatalf("ticket: %v", err)
+		}
+
+		if ticket != want {
+			t.Errorf("ticket: expected %d, got %d", want, ticket)
+		}
+	}
+
+	first, err := s.TakeTurn(ctx, 1)
+	if err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+
+	second := takeTurn(ctx, s, 2)
+	select {
+	case err := <-second:
+		t.Fatalf("second turn: taken while the first is held, %v", err)
+	case <-time.After(3 * s.ClaimTimeout):
+	}
+
+	if p, err := s.Position(ctx, 3); err != nil || p != 2 {
+		t.Errorf("position: expected 2, got %v, %v", p, err)
+	}
+
+	if err := first.Done(ctx); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+
+	if err := <-second; err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+
+	if err := first.Done(ctx); err != ErrLockLost {
+		t.Errorf("done twice: expected %v, got %v", ErrLockLost, err)
+	}
+}
+
+func TestSequencerIdle(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSequencer(newFakeDB(), "idle")
+
+	ticket, _ := s.Ticket(ctx)
+	if err := <-takeTurn(ctx, s, ticket); err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+
+	// the claim window of the next turn started when the first was done
+	time.Sleep(3 * s.ClaimTimeout)
+
+	second, _ := s.Ticket(ctx)
+	third, _ := s.Ticket(ctx)
+	waiting := takeTurn(ctx, s, third)
+
+	time.Sleep(s.ClaimTimeout / 2)
+	turn, err := s.TakeTurn(ctx, second)
+	if err != nil {
+		t.Fatalf("turn of an idle sequencer: %v", err)
+	}
+
+	select {
+	case err := <-waiting:
+		t.Fatalf("third turn: taken while the second is held, %v", err)
+	case <-time.After(3 * s.ClaimTimeout):
+	}
+
+	if err := turn.Done(ctx); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+
+	if err := <-waiting; err != nil {
+		t.Errorf("third turn: %v", err)
+	}
+}
+
+func TestSequencerSkip(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSequencer(newFakeDB(), "skip")
+
+	abandoned, _ := s.Ticket(ctx)
+	ticket, _ := s.Ticket(ctx)
+
+	start := time.Now()
+	if err := <-takeTurn(ctx, s, ticket); err != nil {
+		t.Fatalf("turn after an unclaimed one: %v", err)
+	}
+
+	if d := time.Since(start); d < s.ClaimTimeout {
+		t.Errorf("skipped after %v, before the claim timeout", d)
+	}
+
+	if _, err := s.TakeTurn(ctx, abandoned); err != ErrTurnPassed {
+		t.Errorf("skipped turn: expected %v, got %v", ErrTurnPassed, err)
+	}
+}
+
+func TestSequencerTurnLost(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	s := newTestSequencer(db, "lost")
+	s.TTL = 200 * time.Millisecond
+
+	ticket, _ := s.Ticket(ctx)
+	turn, err := s.TakeTurn(ctx, ticket)
+	if err != nil {
+		t.Fatalf("turn: %v", err)
+	}
+
+	// another waiter skipped the turn
+	name := aws.StringValue(s.key("#serving")["name"].S)
+	serving := db.get(name)
+	delete(serving, "uuid")
+	serving[servingString] = numberAttribute(ticket + 1)
+	db.put(serving)
+
+	select {
+	case <-turn.Lost():
+	case <-time.After(5 * s.TTL):
+		t.Fatalf("lost: not signaled")
+	}
+
+	if err := turn.Err(); err != ErrLockLost {
+		t.Errorf("err: expected %v, got %v", ErrLockLost, err)
+	}
+
+	if err := turn.Done(ctx); err != ErrLockLost {
+		t.Errorf("done: expected %v, got %v", ErrLockLost, err)
+	}
+}
@@ -0,0 +1,97 @@
+package ddblock
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// SessionOptions, if set, are used to create the session of the default
+// clients, for example to select a shared config profile. It must be set
+// before the first lock is used, see SetSession to replace the session later.
+var SessionOptions *session.Options
+
+var (
+	sess  *session.Session
+	svc   *dynamodb.DynamoDB
+	svcLk sync.Mutex
+)
+
+// SetSession makes the default clients use the session, so locks share the
+// application's established credentials, such as custom stscreds, and
+// configuration instead of creating their own. A nil session goes back to
+// creating one on first use. Locks already held keep working, their next
+// requests use the new session.
+func SetSession(s *session.Session) {
+	svcLk.Lock()
+	defer svcLk.Unlock()
+
+	sess = s
+	svc = nil
+	streamSvc = nil
+}
+
+// getSession returns the session shared by the default clients.
+// Must be called with svcLk held.
+func getSession() *session.Session {
+	if sess != nil {
+		return sess
+	}
+
+	opts := session.Options{
+		Config:            *aws.NewConfig().WithMaxRetries(3),
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if SessionOptions != nil {
+		opts = *SessionOptions
+	}
+
+	if DefaultRegion != "" {
+		opts.Config.Region = aws.String(DefaultRegion)
+	}
+
+	if DefaultEndpoint != "" {
+		opts.Config.Endpoint = aws.String(DefaultEndpoint)
+	}
+
+	s, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		// invalid shared config, requests will fail with the error.
+		s = session.New(&opts.Config)
+	}
+
+	// an explicit region in the options or DDBLOCK_REGION wins.
+	if aws.StringValue(s.Config.Region) == "" && DefaultEndpoint != "" {
+		// requests are still signed with a region, any will do locally.
+		s.Config.Region = aws.String("us-east-1")
+	} else if aws.StringValue(s.Config.Region) == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), identityTimeout)
+		region, err := ec2metadata.New(s, aws.NewConfig().WithMaxRetries(0)).RegionWithContext(ctx)
+		cancel()
+
+		if err == nil {
+			s.Config.Region = aws.String(region)
+		}
+	}
+
+	sess = s
+	return sess
+}
+
+// getSvc enables the initialization on first read (ie. after config has been parsed),
+// kind of like a singleton class.
+func getSvc() *dynamodb.DynamoDB {
+	svcLk.Lock()
+	defer svcLk.Unlock()
+
+	if svc == nil {
+		svc = dynamodb.New(getSession())
+	}
+
+	return svc
+}
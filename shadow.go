@@ -0,0 +1,19 @@
+package ddblock
+
+import (
+	"expvar"
+)
+
+// shadowStats counts what would have happened to Shadow mode locks,
+// published with expvar as "ddblock_shadow". The keys are:
+//
+//	acquired  the lock was free
+//	stolen    the lock was taken over from an expired holder
+//	conflict  the lock was held by another and TryLock would have failed
+//	lost      a renewal or Unlock found the lock taken by another
+var shadowStats = expvar.NewMap("ddblock_shadow")
+
+// shadowOutcome records an outcome of a Shadow mode lock.
+func shadowOutcome(outcome string) {
+	shadowStats.Add(outcome, 1)
+}
@@ -0,0 +1,86 @@
+package ddblock
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// maxBatchWrite is the most items a single BatchWriteItem can write.
+const maxBatchWrite = 25
+
+// shardName returns the name of the i-th shard item of the lock.
+func (m *Mutex) shardName(i int) string {
+	return m.fullname + "#shard-" + strconv.Itoa(i)
+}
+
+// waiterShard returns the shard polled by this mutex while waiting,
+// spreading the waiters evenly over the shards.
+func (m *Mutex) waiterShard() int {
+	h := fnv.New32a()
+	h.Write([]byte(m.uuid))
+	return int(h.Sum32() % uint32(m.Shards))
+}
+
+// publishShards copies the holder and expiry of the lock item to every shard
+// item, or removes them if release is true. The shards are only hints for
+// waiters, the lock item itself decides who holds the lock, so failures are
+// ignored. A waiter reading a missing shard item tries the lock anyway.
+// Must be called with m.lk held.
+func (m *Mutex) publishShards(ctx context.Context, item map[string]*dynamodb.AttributeValue, release bool) {
+	var requests []*dynamodb.WriteRequest
+	for i := 0; i < m.Shards; i++ {
+		key := m.Schema.key(m.shardName(i))
+		if release {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{
+					Key: key,
+				},
+			})
+			continue
+		}
+
+		shard := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			shard[k] = v
+		}
+		for k, v := range key {
+			shard[k] = v
+		}
+
+		requests = append(requests, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: shard},
+		})
+	}
+
+	for len(requests) > 0 {
+		n := len(requests)
+		if n > maxBatchWrite {
+			n = maxBatchWrite
+		}
+
+		m.db().BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				m.TableName: requests[:n],
+			},
+		})
+		requests = requests[n:]
+	}
+}
+
+// shardHolder reads the waiter's shard item, with an eventually consistent
+// read, and returns the holder it names or nil if it is missing.
+func (m *Mutex) shardHolder(ctx context.Context) (*LockInfo, error) {
+	resp, err := m.db().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: &m.TableName,
+		Key:       m.Schema.key(m.shardName(m.waiterShard())),
+	})
+	if err != nil || len(resp.Item) == 0 {
+		return nil, err
+	}
+
+	return m.Schema.lockInfo(resp.Item), nil
+}
@@ -0,0 +1,106 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// LeaseState is the serializable state of a held lock. It can be stored,
+// for example in the state of a Step Functions execution, and given to
+// Resume in a later task to renew or release the lock. This supports
+// workflows where no single process holds the lock for the whole duration.
+type LeaseState struct {
+	Table        string        `json:"table"`
+	Name         string        `json:"name"`
+	Item         string        `json:"item"`
+	UUID         string        `json:"uuid"`
+	TTL          time.Duration `json:"ttl"`
+	ExpiryFormat ExpiryFormat  `json:"expiry_format"`
+	Owner        *Owner        `json:"owner,omitempty"`
+	Payload      []byte        `json:"payload,omitempty"`
+
+	// Schema is the schema of the table, nil for the DefaultSchema.
+	Schema   *Schema           `json:"schema,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+
+	// Fence is the fencing token of the lease, if it uses Fencing.
+	Fence int64 `json:"fence,omitempty"`
+
+	// Expires is the wall clock time the lease expires,
+	// as of the last renewal before the state was taken.
+	Expires time.Time `json:"expires"`
+}
+
+// State returns the serializable state of the held lock.
+// ErrNotHeld is returned if the lock is not held.
+func (m *Mutex) State() (LeaseState, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" || m.renewed.IsZero() {
+		return LeaseState{}, ErrNotHeld
+	}
+
+	return LeaseState{
+		Table:        m.TableName,
+		Name:         m.name,
+		Item:         m.fullname,
+		UUID:         m.uuid,
+		TTL:          m.ttl,
+		ExpiryFormat: m.ExpiryFormat,
+		Owner:        m.owner,
+		Payload:      m.payload,
+		Schema:       m.Schema,
+		Metadata:     m.Metadata,
+		Reason:       m.Reason,
+		Fence:        m.fence,
+		Expires:      time.Now().Add(m.remaining()),
+	}, nil
+}
+
+// Resume returns a mutex for a lock held by another process, or an earlier
+// invocation of this one, as described by the state. The mutex is in
+// ManualRenew mode, the caller must call Renew to keep the lock and Unlock
+// to release it. Since the time of the last renewal is not known locally the
+// lease is assumed to end at the state's wall clock expiry. The options, as
+// with New, configure the mutex, for example its client, but the lease is
+// the state's.
+func Resume(ctx context.Context, state LeaseState, opts ...Option) *Mutex {
+	m := New(ctx, state.Name, opts...)
+	m.TableName = state.Table
+	m.ExpiryFormat = state.ExpiryFormat
+	m.ManualRenew = true
+	if state.Schema != nil {
+		m.Schema = state.Schema
+	}
+
+	if state.Metadata != nil {
+		m.Metadata = state.Metadata
+	}
+
+	if state.Reason != "" {
+		m.Reason = state.Reason
+	}
+
+	m.fullname = state.Item
+	m.uuid = state.UUID
+	m.owner = state.Owner
+	m.payload = state.Payload
+	if state.Fence > 0 {
+		m.Fencing = true
+		m.fence = state.Fence
+	}
+
+	if state.TTL > 0 {
+		m.TTL = state.TTL
+	}
+
+	m.ttl = m.cleanTTL()
+	m.renewed = time.Now().Add(time.Until(state.Expires) - m.ttl)
+	m.acquired = time.Now()
+	m.leaseChannels()
+
+	return m
+}
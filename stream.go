@@ -0,0 +1,403 @@
+package ddblock
+
+import (
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+
+	"golang.org/x/net/context"
+)
+
+// streamPollInterval is how often each shard of a table's stream is read.
+// DynamoDB allows up to 5 reads per second per shard, shared by all readers.
+const streamPollInterval = time.Second
+
+// streamRefreshInterval is how often the shards of a stream are relisted to
+// find the children of shards that were split or closed.
+const streamRefreshInterval = time.Minute
+
+var (
+	streamSvc *dynamodbstreams.DynamoDBStreams
+
+	watchers   = map[watcherKey]*streamWatcher{}
+	watchersLk sync.Mutex
+)
+
+// getStreamSvc returns the default dynamodb streams client
+// sharing the session of the default dynamodb client.
+func getStreamSvc() *dynamodbstreams.DynamoDBStreams {
+	svcLk.Lock()
+	defer svcLk.Unlock()
+
+	if streamSvc == nil {
+		streamSvc = dynamodbstreams.New(getSession())
+	}
+
+	return streamSvc
+}
+
+// EventType is the kind of change to a lock item seen on the stream.
+type EventType int
+
+const (
+	// EventAcquired is a new lock item, or a takeover by a new holder.
+	EventAcquired EventType = iota + 1
+
+	// EventRenewed is an update of the expiry by the same holder.
+	EventRenewed
+
+	// EventReleased is the lock item being deleted by its holder or a tool.
+	EventReleased
+
+	// EventExpired is the lock item being deleted by DynamoDB TTL.
+	EventExpired
+
+	// EventSteppingDown is the holder starting a graceful Resign.
+	EventSteppingDown
+)
+
+// LockEvent is a change to a lock item seen on the table's stream.
+type LockEvent struct {
+	Type EventType
+
+	// Name is the name of the item, including the prefix.
+	Name string
+
+	// Lock is the item after the change or, for removals, before it.
+	// Only the name is set if the stream does not include item images.
+	Lock *LockInfo
+}
+
+// eventBuffer is the number of events buffered for each subscriber.
+// Events for a subscriber that falls further behind are dropped.
+const eventBuffer = 64
+
+// subscription is a subscriber to the events of one lock item, or all
+// of them if fullname is empty. If removals is set only EventReleased and
+// EventExpired are delivered.
+type subscription struct {
+	fullname string
+	removals bool
+	c        chan LockEvent
+}
+
+// watcherKey identifies a table by its client, which determines the
+// region and account, and name.
+type watcherKey struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// streamWatcher reads the stream of a table and notifies subscribers
+// of changes to lock items. One watcher is shared by every subscriber
+// for the table in the process, the schema is that of the first.
+type streamWatcher struct {
+	key     watcherKey
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI
+	schema  *Schema
+	cancel  func()
+
+	lk   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+// subscribe returns a channel that receives the events for the item named
+// fullname, or all items if it is empty, of the table read with the clients
+// and with the schema.
+// The returned func must be called to stop watching, it closes the channel.
+// The table must have a stream enabled that includes keys, otherwise nothing
+// is ever delivered.
+func subscribe(
+	db dynamodbiface.DynamoDBAPI,
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI,
+	table, fullname string,
+	schema *Schema,
+	removals bool,
+) (<-chan LockEvent, func()) {
+	watchersLk.Lock()
+	defer watchersLk.Unlock()
+
+	key := watcherKey{db: db, table: table}
+	w := watchers[key]
+	if w == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		w = &streamWatcher{
+			key:     key,
+			streams: streams,
+			schema:  schema,
+			cancel:  cancel,
+			subs:    make(map[*subscription]struct{}),
+		}
+		watchers[key] = w
+
+		go pprof.Do(ctx, pprof.Labels("ddblock_stream", table), w.run)
+	}
+
+	sub := &subscription{
+		fullname: fullname,
+		removals: removals,
+		c:        make(chan LockEvent, eventBuffer),
+	}
+
+	w.lk.Lock()
+	w.subs[sub] = struct{}{}
+	w.lk.Unlock()
+
+	var once sync.Once
+	return sub.c, func() { once.Do(func() { w.unsubscribe(sub) }) }
+}
+
+func (w *streamWatcher) unsubscribe(sub *subscription) {
+	watchersLk.Lock()
+	defer watchersLk.Unlock()
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	delete(w.subs, sub)
+	close(sub.c)
+
+	if len(w.subs) == 0 {
+		w.cancel()
+		delete(watchers, w.key)
+	}
+}
+
+// notify delivers the event to its subscribers without blocking.
+// A waiter that has not yet read a previous event misses nothing
+// since it will attempt to acquire the lock anyway.
+func (w *streamWatcher) notify(e LockEvent) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	removal := e.Type == EventReleased || e.Type == EventExpired
+	for sub := range w.subs {
+		if sub.fullname != "" && sub.fullname != e.Name {
+			continue
+		}
+
+		if sub.removals && !removal {
+			continue
+		}
+
+		select {
+		case sub.c <- e:
+		default:
+		}
+	}
+}
+
+// run polls the open shards of the stream until the context is canceled.
+// Errors are retried after a delay; subscribers fall back to polling
+// the lock item while the stream can not be read.
+func (w *streamWatcher) run(ctx context.Context) {
+	var (
+		arn       string
+		iterators map[string]*string
+		refreshed time.Time
+	)
+
+	seen := make(map[string]bool)
+	for ctx.Err() == nil {
+		if arn == "" || time.Since(refreshed) > streamRefreshInterval {
+			var err error
+			arn, err = w.streamArn(ctx)
+			if err == nil {
+				iterators, err = w.openShards(ctx, arn, iterators, seen)
+			}
+
+			if err != nil {
+				arn = ""
+				sleep(ctx, streamRefreshInterval)
+				continue
+			}
+
+			refreshed = time.Now()
+		}
+
+		for id, it := range iterators {
+			resp, err := w.streams.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{
+				ShardIterator: it,
+			})
+			if err != nil {
+				if e, ok := err.(awserr.Error); ok && (e.Code() == dynamodbstreams.ErrCodeExpiredIteratorException ||
+					e.Code() == dynamodbstreams.ErrCodeTrimmedDataAccessException) {
+					// get a new iterator on the next refresh
+					delete(iterators, id)
+					delete(seen, id)
+					refreshed = time.Time{}
+				}
+
+				continue
+			}
+
+			for _, r := range resp.Records {
+				if e, ok := eventFromRecord(r, w.schema); ok {
+					w.notify(e)
+				}
+			}
+
+			if resp.NextShardIterator == nil {
+				// the shard has been closed, its children are found on refresh
+				delete(iterators, id)
+				refreshed = time.Time{}
+				continue
+			}
+
+			iterators[id] = resp.NextShardIterator
+		}
+
+		sleep(ctx, streamPollInterval)
+	}
+}
+
+// streamArn returns the arn of the latest stream of the table.
+func (w *streamWatcher) streamArn(ctx context.Context) (string, error) {
+	resp, err := w.key.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: &w.key.table,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	arn := aws.StringValue(resp.Table.LatestStreamArn)
+	if arn == "" {
+		return "", awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table "+w.key.table+" has no stream", nil)
+	}
+
+	return arn, nil
+}
+
+// openShards adds iterators for open shards that have not been seen before.
+// Shards present when the watcher starts are read from the latest record,
+// shards created after that are read from the start so no event is missed.
+func (w *streamWatcher) openShards(
+	ctx context.Context,
+	arn string,
+	iterators map[string]*string,
+	seen map[string]bool,
+) (map[string]*string, error) {
+	first := iterators == nil
+	if first {
+		iterators = make(map[string]*string)
+	}
+
+	var start *string
+	for {
+		resp, err := w.streams.DescribeStreamWithContext(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             &arn,
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return iterators, err
+		}
+
+		for _, shard := range resp.StreamDescription.Shards {
+			id := aws.StringValue(shard.ShardId)
+			if seen[id] {
+				continue
+			}
+
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				// closed, nothing new will be written to it
+				continue
+			}
+
+			typ := dynamodbstreams.ShardIteratorTypeTrimHorizon
+			if first {
+				typ = dynamodbstreams.ShardIteratorTypeLatest
+			}
+
+			it, err := w.streams.GetShardIteratorWithContext(ctx, &dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         &arn,
+				ShardId:           shard.ShardId,
+				ShardIteratorType: aws.String(typ),
+			})
+			if err != nil {
+				return iterators, err
+			}
+
+			seen[id] = true
+			iterators[id] = it.ShardIterator
+		}
+
+		start = resp.StreamDescription.LastEvaluatedShardId
+		if start == nil {
+			return iterators, nil
+		}
+	}
+}
+
+// ttlPrincipal is the principal of deletes made by DynamoDB TTL.
+const ttlPrincipal = "dynamodb.amazonaws.com"
+
+// eventFromRecord converts a stream record into a lock event.
+// Records that do not have a name key, or the sort key of the lock
+// items, for example from other items in the table, are skipped.
+func eventFromRecord(r *dynamodbstreams.Record, schema *Schema) (LockEvent, bool) {
+	if r.Dynamodb == nil || r.Dynamodb.Keys[schema.keyName()] == nil {
+		return LockEvent{}, false
+	}
+
+	if sk := schema.sortKeyName(); sk != "" {
+		if v := r.Dynamodb.Keys[sk]; v == nil || aws.StringValue(v.S) != schema.SortValue {
+			return LockEvent{}, false
+		}
+	}
+
+	e := LockEvent{
+		Name: aws.StringValue(r.Dynamodb.Keys[schema.keyName()].S),
+	}
+
+	var image map[string]*dynamodb.AttributeValue
+	switch aws.StringValue(r.EventName) {
+	case dynamodbstreams.OperationTypeInsert:
+		e.Type = EventAcquired
+		image = r.Dynamodb.NewImage
+	case dynamodbstreams.OperationTypeModify:
+		e.Type = EventRenewed
+		image = r.Dynamodb.NewImage
+
+		if o, n := r.Dynamodb.OldImage[schema.uuidName()], r.Dynamodb.NewImage[schema.uuidName()]; o != nil && n != nil &&
+			aws.StringValue(o.S) != aws.StringValue(n.S) {
+			e.Type = EventAcquired
+		} else if o, n := r.Dynamodb.OldImage[steppingDownString], r.Dynamodb.NewImage[steppingDownString]; o == nil && n != nil {
+			e.Type = EventSteppingDown
+		} else if o, n := r.Dynamodb.OldImage[releasedAtString], r.Dynamodb.NewImage[releasedAtString]; o == nil && n != nil {
+			// replaced by a tombstone
+			e.Type = EventReleased
+		}
+	case dynamodbstreams.OperationTypeRemove:
+		e.Type = EventReleased
+		image = r.Dynamodb.OldImage
+
+		if id := r.UserIdentity; id != nil && aws.StringValue(id.PrincipalId) == ttlPrincipal {
+			e.Type = EventExpired
+		}
+	default:
+		return LockEvent{}, false
+	}
+
+	if len(image) == 0 {
+		image = r.Dynamodb.Keys
+	}
+
+	e.Lock = schema.lockInfo(image)
+
+	return e, true
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,127 @@
+package ddblock
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"golang.org/x/net/context"
+)
+
+// TableConfig describes the lock table created by EnsureTable.
+type TableConfig struct {
+	// Client defaults to the default dynamodb client.
+	Client dynamodbiface.DynamoDBAPI
+
+	// TableName defaults to DefaultTableName.
+	TableName string
+
+	// Streams enables the table's stream with new and old images,
+	// for WaitOnStream and Inspector.Watch.
+	Streams bool
+
+	// Schema names the hash key, and sort key if any, DefaultSchema if nil.
+	// Its ExpiryIndex, if set, is created with the table.
+	Schema *Schema
+}
+
+// EnsureTable creates the lock table, on demand with a string hash key
+// named by the Schema, "name" by default, and its string sort key if any,
+// if it does not exist and waits for it to be active. DynamoDB TTL is then
+// enabled on the "ttl" attribute, unless TTL is already enabled, so
+// abandoned lock items are deleted. An existing table is otherwise left as is.
+func EnsureTable(ctx context.Context, cfg TableConfig) error {
+	db := cfg.Client
+	if db == nil {
+		db = getSvc()
+	}
+
+	table := cfg.TableName
+	if table == "" {
+		table = DefaultTableName
+	}
+
+	params := &dynamodb.CreateTableInput{
+		TableName:   &table,
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(cfg.Schema.keyName()),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(cfg.Schema.keyName()),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+	}
+
+	if sk := cfg.Schema.sortKeyName(); sk != "" {
+		params.AttributeDefinitions = append(params.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(sk),
+			AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+		})
+		params.KeySchema = append(params.KeySchema, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(sk),
+			KeyType:       aws.String(dynamodb.KeyTypeRange),
+		})
+	}
+
+	if index := cfg.Schema.expiryIndex(); index != "" {
+		params.AttributeDefinitions = append(params.AttributeDefinitions,
+			&dynamodb.AttributeDefinition{
+				AttributeName: &expiryPartitionString,
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+			&dynamodb.AttributeDefinition{
+				AttributeName: aws.String(cfg.Schema.expiresName()),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeN),
+			},
+		)
+		params.GlobalSecondaryIndexes = []*dynamodb.GlobalSecondaryIndex{{
+			IndexName: aws.String(index),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: &expiryPartitionString,
+					KeyType:       aws.String(dynamodb.KeyTypeHash),
+				},
+				{
+					AttributeName: aws.String(cfg.Schema.expiresName()),
+					KeyType:       aws.String(dynamodb.KeyTypeRange),
+				},
+			},
+			Projection: &dynamodb.Projection{
+				ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+			},
+		}}
+	}
+
+	if cfg.Streams {
+		params.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+		}
+	}
+
+	_, err := db.CreateTableWithContext(ctx, params)
+	if e, ok := err.(awserr.Error); ok && e.Code() == dynamodb.ErrCodeResourceInUseException {
+		// it exists, or is being created
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = db.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return err
+	}
+
+	return enableTTL(ctx, db, table)
+}
@@ -0,0 +1,130 @@
+package ddblock
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Op is a dynamodb operation made by a Mutex.
+type Op int
+
+const (
+	// OpAcquire is a conditional put to take the lock.
+	OpAcquire Op = iota + 1
+
+	// OpRenew is a conditional put extending the lease.
+	OpRenew
+
+	// OpRelease is a conditional delete of the lock item.
+	OpRelease
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpAcquire:
+		return "acquire"
+	case OpRenew:
+		return "renew"
+	case OpRelease:
+		return "release"
+	}
+
+	return "unknown"
+}
+
+// TraceEvent describes one operation, given to the Trace hook.
+type TraceEvent struct {
+	Op       Op
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+
+	// Err is the result of the operation. It is a conditional check
+	// failure if an acquire found the lock held by another.
+	Err error
+
+	// Context has the values of the mutex's context, such as an X-Ray
+	// segment, and was used for the request. It is never canceled.
+	Context context.Context
+}
+
+// Sampling sets the fraction, from 0 to 1, of operations reported to the
+// Trace hook. With thousands of locks reporting every renewal can cost
+// more than the locking itself, while failures are rarer and more relevant.
+type Sampling struct {
+	Acquires float64
+	Renewals float64
+	Releases float64
+
+	// Failures applies to any operation that returned an error,
+	// other than an acquire finding the lock held by another.
+	Failures float64
+}
+
+// DefaultSampling reports every operation and is used when a Mutex's
+// Sampling is nil.
+var DefaultSampling = Sampling{
+	Acquires: 1,
+	Renewals: 1,
+	Releases: 1,
+	Failures: 1,
+}
+
+// sampled returns true if the operation should be reported.
+func (s *Sampling) sampled(op Op, err error) bool {
+	if s == nil {
+		s = &DefaultSampling
+	}
+
+	rate := s.Failures
+	if err == nil || (op == OpAcquire && IsAquireError(err)) {
+		switch op {
+		case OpAcquire:
+			rate = s.Acquires
+		case OpRenew:
+			rate = s.Renewals
+		case OpRelease:
+			rate = s.Releases
+		}
+	}
+
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+// trace reports the operation to the Metrics and to the Trace hook, if
+// sampled. Must be called with m.lk held.
+func (m *Mutex) trace(op Op, start time.Time, err error) {
+	m.observe(op, time.Since(start), err)
+
+	if m.Trace == nil || !m.Sampling.sampled(op, err) {
+		return
+	}
+
+	m.Trace(TraceEvent{
+		Op:       op,
+		Name:     m.name,
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      err,
+		Context:  m.opContext(),
+	})
+}
+
+// opContext returns the context of the dynamodb requests. It keeps the values
+// of the mutex's context, so the requests are traced with it, but not its
+// cancellation, since a release or manual renewal must still be sent after
+// the context is canceled.
+func (m *Mutex) opContext() context.Context {
+	return valuesOnly{m.ctx}
+}
+
+// valuesOnly is a context with the values of another, but never canceled.
+type valuesOnly struct {
+	context.Context
+}
+
+func (valuesOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesOnly) Done() <-chan struct{}       { return nil }
+func (valuesOnly) Err() error                  { return nil }
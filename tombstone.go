@@ -0,0 +1,53 @@
+package ddblock
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var (
+	releasedAtString = "released_at"
+	heldForString    = "held_for"
+)
+
+// expireInPlace returns the put that releases the lock by expiring the item
+// now instead of deleting it. This keeps the heir designation, starting the
+// heir window, and with Tombstones records how long the lock was held. The
+// release time is always recorded so the next holder does not mistake the
+// item for an expired lease it took over. Must be called with m.lk held.
+func (m *Mutex) expireInPlace() *dynamodb.PutItemInput {
+	now := time.Now()
+
+	item := m.item(now)
+	delete(item, steppingDownString)
+	item[releasedAtString] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(now.UnixNano(), 10)),
+	}
+
+	if m.Tombstones && !m.acquired.IsZero() {
+		item[heldForString] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(int64(now.Sub(m.acquired)), 10)),
+		}
+	}
+
+	return &dynamodb.PutItemInput{
+		TableName:           &m.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("#name = :name AND #uuid = :uuid"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String(m.Schema.keyName()),
+			"#uuid": aws.String(m.Schema.uuidName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: &m.fullname,
+			},
+			":uuid": {
+				S: aws.String(m.uuid),
+			},
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package ddblock
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNotTransactional is returned when the lock item can not be written or
+// checked in a transaction, because the lock is stored in a Backend or is
+// not enforced.
+var ErrNotTransactional = errors.New("ddbmutex: lock item can not be checked in a transaction")
+
+// HolderCheck returns a condition check that the lock item still belongs
+// to this mutex, by name and uuid, and has not expired, to add to the
+// caller's own transaction. ErrNotHeld is returned if the lock is not held.
+func (m *Mutex) HolderCheck() (*dynamodb.ConditionCheck, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.uuid == "" || m.renewed.IsZero() {
+		return nil, ErrNotHeld
+	}
+
+	if m.backend != nil || m.mode == Advisory || m.shadowed {
+		return nil, ErrNotTransactional
+	}
+
+	return &dynamodb.ConditionCheck{
+		TableName:           aws.String(m.TableName),
+		Key:                 m.Schema.key(m.fullname),
+		ConditionExpression: aws.String("#name = :name AND #uuid = :uuid AND #exp > :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String(m.Schema.keyName()),
+			"#uuid": aws.String(m.Schema.uuidName()),
+			"#exp":  aws.String(m.Schema.expiresName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: aws.String(m.fullname),
+			},
+			":uuid": {
+				S: aws.String(m.uuid),
+			},
+			":now": {
+				N: aws.String(m.formatExpires(time.Now())),
+			},
+		},
+	}, nil
+}
+
+// TransactWrite makes the writes in one transaction with the HolderCheck,
+// so they are only made while this mutex holds the lock. ErrLockLost is
+// returned, and nothing is written, if the lock item belongs to someone
+// else or has expired. Other failed conditions, on the caller's items,
+// return the *dynamodb.TransactionCanceledException. The writes can not
+// include the lock item and at most 99 can be made together.
+func (m *Mutex) TransactWrite(ctx context.Context, items []*dynamodb.TransactWriteItem) error {
+	check, err := m.HolderCheck()
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db().TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: append([]*dynamodb.TransactWriteItem{{ConditionCheck: check}}, items...),
+	})
+
+	var e *dynamodb.TransactionCanceledException
+	if errors.As(err, &e) && len(e.CancellationReasons) > 0 &&
+		aws.StringValue(e.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return ErrLockLost
+	}
+
+	return wrapError(err)
+}
@@ -0,0 +1,63 @@
+package ddblock
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"golang.org/x/net/context"
+)
+
+// ttlString is the attribute registered with DynamoDB TTL by EnsureTable.
+// It is always in unix seconds, as TTL requires, whatever the ExpiryFormat.
+var ttlString = "ttl"
+
+// DefaultCleanupDelay is how long after a lock item expires DynamoDB TTL
+// may delete it, so abandoned items do not accumulate forever. TTL deletes
+// lazily, expiry is still checked by the conditions for correctness. The
+// delay keeps tombstones and heir designations around for a while.
+var DefaultCleanupDelay = time.Hour
+
+// ttlAttribute returns the TTL attribute of an item expiring at the time.
+func ttlAttribute(expires time.Time) *dynamodb.AttributeValue {
+	t := expires.Add(DefaultCleanupDelay)
+
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(sec, 10)),
+	}
+}
+
+// enableTTL registers the ttl attribute with DynamoDB TTL,
+// unless TTL is already enabled on the table.
+func enableTTL(ctx context.Context, db dynamodbiface.DynamoDBAPI, table string) error {
+	resp, err := db.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return err
+	}
+
+	if d := resp.TimeToLiveDescription; d != nil {
+		switch aws.StringValue(d.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			return nil
+		}
+	}
+
+	_, err = db.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: &table,
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: &ttlString,
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
@@ -0,0 +1,173 @@
+package ddblock
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultRetryInterval is the base delay between attempts of LockWait.
+var DefaultRetryInterval = time.Second
+
+// maxRecentConflicts limits how many conflict times are remembered.
+const maxRecentConflicts = 64
+
+// LockWait is like TryLock but, if someone else holds the lock, it retries
+// until the lock is acquired or the context is done, returning how long it
+// waited. The next attempt is scheduled just after the current holder's
+// lease, plus grace, would expire. An earlier release by the holder is
+// noticed at that point. Retry times are randomized over a window that
+// doubles with every recent conflict, up to MaxRetryInterval, so many waiters
+// for the same lock back off and spread out instead of retrying in lock step.
+//
+// If WaitOnStream is set the table's stream is watched and the lock is
+// retried right after it is released, or removed by DynamoDB TTL.
+// If the HoldLimit is reached it waits for another lock to be released.
+func (m *Mutex) LockWait(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := m.jitter(ctx); err != nil {
+		return time.Since(start), err
+	}
+
+	var released <-chan LockEvent
+	if m.WaitOnStream {
+		// subscribe before the first attempt so a release is not missed
+		var stop func()
+		released, stop = subscribe(m.db(), m.streamsDB(), m.TableName, m.fullname, m.Schema, true)
+		defer stop()
+	}
+
+	for {
+		// with shards, only try the lock item when the shard shows it free
+		if m.Shards == 0 || !m.shardHeld(ctx) {
+			err := m.TryLock()
+			if err == ErrHoldLimit {
+				if err := m.Limit.wait(ctx); err != nil {
+					return time.Since(start), err
+				}
+
+				continue
+			}
+
+			if !IsAquireError(err) {
+				return time.Since(start), err
+			}
+		}
+
+		select {
+		case <-time.After(m.retryDelay()):
+		case <-released:
+		case <-ctx.Done():
+			return time.Since(start), ctx.Err()
+		}
+	}
+}
+
+// jitter waits a random part of InitialJitter before the first
+// acquisition attempt of the mutex.
+func (m *Mutex) jitter(ctx context.Context) error {
+	m.lk.Lock()
+	first := !m.jittered
+	m.jittered = true
+	m.lk.Unlock()
+
+	if !first || m.InitialJitter <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(m.InitialJitter)))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shardHeld checks the waiter's shard item and returns true, recording
+// the holder, if it shows the lock is still held.
+func (m *Mutex) shardHeld(ctx context.Context) bool {
+	holder, err := m.shardHolder(ctx)
+	if err != nil || holder == nil {
+		return false
+	}
+
+	now := time.Now()
+	if !now.Before(holder.Expires.Add(m.Grace)) {
+		return false
+	}
+
+	m.lk.Lock()
+	m.recordConflict(now, holder)
+	m.lk.Unlock()
+
+	return true
+}
+
+// recordConflict notes that an attempt to acquire the lock failed
+// because of another holder, which may be nil if not known.
+// Must be called with m.lk held.
+func (m *Mutex) recordConflict(now time.Time, holder *LockInfo) {
+	m.lastHolder = holder
+	m.conflicts = append(m.conflicts, now)
+	if len(m.conflicts) > maxRecentConflicts {
+		m.conflicts = m.conflicts[len(m.conflicts)-maxRecentConflicts:]
+	}
+}
+
+// retryDelay returns a random delay before the next attempt. It is at least
+// half the retry interval, spread over a window of one retry interval doubled
+// for every conflict seen during the last TTL, up to MaxRetryInterval. This
+// jitter is added to the time until the last seen holder's lease would expire.
+func (m *Mutex) retryDelay() time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	base := m.RetryInterval
+	if base <= 0 {
+		base = DefaultRetryInterval
+	}
+
+	ttl := m.cleanTTL()
+	recent := m.conflicts[:0]
+	for _, t := range m.conflicts {
+		if time.Since(t) < ttl {
+			recent = append(recent, t)
+		}
+	}
+	m.conflicts = recent
+
+	max := m.MaxRetryInterval
+	if max <= 0 {
+		max = ttl
+	}
+
+	// doubled one conflict at a time, stopping at max before it can overflow
+	window := base
+	for i := 0; i < len(recent) && window < max; i++ {
+		if window >= max/2 {
+			window = max
+			break
+		}
+
+		window *= 2
+	}
+
+	if window > max {
+		window = max
+	}
+
+	jitter := base/2 + time.Duration(rand.Int63n(int64(window)))
+
+	var wait time.Duration
+	if m.lastHolder != nil && !m.lastHolder.Expires.IsZero() {
+		// the holder's expiry is a wall clock time from its own machine,
+		// grace covers the skew between the two.
+		wait = time.Until(m.lastHolder.Expires.Add(m.Grace))
+		if wait < 0 {
+			wait = 0
+		}
+	}
+
+	return wait + jitter
+}
@@ -0,0 +1,71 @@
+package ddblock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// WaitUnlocked blocks until the named lock is free, released or expired,
+// without ever acquiring it, or until the context is done. It is for readers
+// that only need to wait for, say, a migration lock to clear. An expired
+// lock is free once the client's Grace has passed too, as for the client's
+// mutexes. The lock item is polled every RetryInterval, doubling up to the
+// client's TTL, but never later than just after the lock would be free.
+func (c *Client) WaitUnlocked(ctx context.Context, name string) error {
+	i := c.NewInspector()
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	interval := c.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+
+	grace := DefaultGrace
+	if c.Grace > 0 {
+		grace = c.Grace
+	}
+
+	backoff := interval
+	for {
+		info, err := i.GetLockInfo(ctx, name)
+		if err != nil {
+			return wrapError(err)
+		}
+
+		now := time.Now()
+		if info == nil || !info.ReleasedAt.IsZero() {
+			return nil
+		}
+
+		free := info.Expires.Add(grace)
+		if !free.After(now) {
+			return nil
+		}
+
+		wait := backoff
+		if d := free.Sub(now) + interval/10; d < wait {
+			wait = d
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > ttl {
+			backoff = ttl
+		}
+	}
+}
+
+// WaitUnlocked blocks until the named lock, in the DefaultTableName with the
+// DefaultPrefix, is free. See Client.WaitUnlocked.
+func WaitUnlocked(ctx context.Context, name string) error {
+	return defaultClient().WaitUnlocked(ctx, name)
+}
@@ -0,0 +1,69 @@
+package ddblock
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ErrWatcherClosed is returned by Watcher.Wait once the watcher is closed.
+var ErrWatcherClosed = errors.New("ddbmutex: watcher closed")
+
+// Watcher delivers the releases and expiries of locks seen on the table's
+// stream, so waiters can be woken as soon as a lock is free instead of
+// polling it. It shares the stream reader of the table with the other
+// watchers and waiters in the process. The stream must be enabled and
+// include keys. Events are dropped if the receiver falls too far behind.
+type Watcher struct {
+	events <-chan LockEvent
+	stop   func()
+
+	// prefix filters events when watching all the locks.
+	prefix string
+	all    bool
+}
+
+// NewWatcher returns a watcher of the releases of the named lock, or all
+// locks with the prefix if name is empty. It must be closed when done.
+func (i *Inspector) NewWatcher(name string) *Watcher {
+	fullname := ""
+	if name != "" {
+		fullname = i.Prefix + name
+	}
+
+	events, stop := subscribe(i.db(), i.streamsDB(), i.TableName, fullname, i.Schema, true)
+	return &Watcher{
+		events: events,
+		stop:   stop,
+		prefix: i.Prefix,
+		all:    name == "",
+	}
+}
+
+// Wait blocks until the next release or expiry, EventReleased or
+// EventExpired, or until the context is done. ErrWatcherClosed is
+// returned if the watcher is closed.
+func (w *Watcher) Wait(ctx context.Context) (LockEvent, error) {
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				return LockEvent{}, ErrWatcherClosed
+			}
+
+			if w.all && (!strings.HasPrefix(e.Name, w.prefix) || helperItem.MatchString(e.Name)) {
+				continue
+			}
+
+			return e, nil
+		case <-ctx.Done():
+			return LockEvent{}, ctx.Err()
+		}
+	}
+}
+
+// Close stops watching, a pending Wait returns ErrWatcherClosed.
+func (w *Watcher) Close() {
+	w.stop()
+}
@@ -0,0 +1,45 @@
+package ddblock
+
+import (
+	"golang.org/x/net/context"
+)
+
+// WithLock acquires the named lock, waiting until it is free or ctx is
+// done, and runs fn while holding it. The context given to fn is canceled
+// if the lease is lost, in which case the reason, see Mutex.Err, is returned
+// once fn returns. The lock is always released before returning. Otherwise
+// fn's error is returned, or the error releasing the lock.
+func WithLock(ctx context.Context, name string, fn func(context.Context) error, opts ...Option) error {
+	m := New(ctx, name, opts...)
+	if _, err := m.LockWait(ctx); err != nil {
+		return err
+	}
+
+	lost := m.Lost()
+
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-lost:
+			cancel()
+		case <-fnCtx.Done():
+		}
+	}()
+
+	err := fn(fnCtx)
+
+	select {
+	case <-lost:
+		m.Abandon()
+		return m.Err()
+	default:
+	}
+
+	if uerr := m.Unlock(); err == nil {
+		err = uerr
+	}
+
+	return err
+}